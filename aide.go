@@ -18,6 +18,9 @@ type Aide struct {
 	PostVar  map[string]string
 	QueryVar map[string]string
 	Body     string
+
+	// transactions of the request (see Tx)
+	txs *txSet
 }
 
 // NewAide creates a new Aide object
@@ -25,9 +28,16 @@ func NewAide(w http.ResponseWriter, r *http.Request) Aide {
 	return Aide{
 		Request:  r,
 		Response: w,
+		txs:      newTxSet(),
 	}
 }
 
+// Principal returns the authenticated caller of the request, as established
+// by an IdentityAuthorizer or a module (see WithPrincipal)
+func (j Aide) Principal() Principal {
+	return principalOf(j.Request)
+}
+
 // LoadVars parses an intializes PostVars, GetVars and Body variables
 func (j *Aide) LoadVars() {
 
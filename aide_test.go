@@ -1,9 +1,12 @@
 package aqua
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 
+	"github.com/mayur-tolexo/aero/db/cstr"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -43,3 +46,49 @@ func TestJarForHttpGETMethod(t *testing.T) {
 
 	})
 }
+
+type txMock struct{}
+
+func (m *txMock) Ok() (int, string)        { return 200, "ok" }
+func (m *txMock) NotFound() (int, string)  { return 404, "nope" }
+func (m *txMock) Err() (string, error)     { return "", errors.New("failed") }
+func (m *txMock) NoErr() (string, error)   { return "fine", nil }
+func (m *txMock) Flt() interface{}         { return Fault{Message: "bad"} }
+func (m *txMock) Map() map[string]string   { return nil }
+func (m *txMock) Panics(j Aide) string     { panic("oops") }
+func (m *txMock) Struct() (Fixture, error) { return Fixture{}, nil }
+
+func TestAideTransactionOutcome(t *testing.T) {
+
+	Convey("Given the outputs of a handler", t, func() {
+		outcome := func(name string) bool {
+			inv := NewMethodInvoker(&txMock{}, name)
+			return failed(inv.Do(nil), inv.outParams)
+		}
+		Convey("Then 2xx codes and nil errors should commit", func() {
+			So(outcome("Ok"), ShouldBeFalse)
+			So(outcome("NoErr"), ShouldBeFalse)
+			So(outcome("Map"), ShouldBeFalse)
+			So(outcome("Struct"), ShouldBeFalse)
+		})
+		Convey("Then other codes, errors and Faults should roll back", func() {
+			So(outcome("NotFound"), ShouldBeTrue)
+			So(outcome("Err"), ShouldBeTrue)
+			So(outcome("Flt"), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a handler that panics", t, func() {
+		Convey("Then the panic should be passed on after the rollback", func() {
+			ep := endPoint{exec: NewMethodInvoker(&txMock{}, "Panics")}
+			j := NewAide(nil, nil)
+			So(func() { ep.invoke([]reflect.Value{reflect.ValueOf(j)}, &j) }, ShouldPanicWith, "oops")
+		})
+	})
+
+	Convey("Given an Aide that was not created by aqua", t, func() {
+		Convey("Then asking for a transaction should panic", func() {
+			So(func() { Aide{}.Tx(cstr.Storage{Engine: "mysql", Conn: "blah"}) }, ShouldPanic)
+		})
+	})
+}
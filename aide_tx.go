@@ -0,0 +1,155 @@
+package aqua
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/db/cstr"
+	"github.com/mayur-tolexo/aero/db/orm"
+	"github.com/mayur-tolexo/aero/refl"
+)
+
+// txSet holds the transactions opened during a request, one per storage
+type txSet struct {
+	sync.Mutex
+	txs   map[string]*gorm.DB
+	order []string
+
+	// run once the transactions are committed
+	done []func()
+}
+
+func newTxSet() *txSet {
+	return &txSet{
+		txs:   make(map[string]*gorm.DB),
+		order: make([]string, 0),
+	}
+}
+
+// Tx returns the transaction of this request on the given storage, opening
+// it on first use. Once the handler returns, aqua commits the transactions
+// of the request, unless the handler fails (returns an error or a Fault, a
+// status code outside 2xx or panics) in which case they are rolled back.
+// CRUD endpoints and their hooks use the same transactions.
+func (j Aide) Tx(s cstr.Storage) *gorm.DB {
+	if j.txs == nil {
+		panic("Aide.Tx needs an Aide created by aqua (or NewAide)")
+	}
+	if s.Engine == "" && s.Conn == "" {
+		s = cstr.Get(true)
+	}
+
+	j.txs.Lock()
+	defer j.txs.Unlock()
+
+	key := s.Engine + "|" + s.Conn
+	if tx, found := j.txs.txs[key]; found {
+		return tx
+	}
+	tx := orm.GetConn(s.Engine, s.Conn).Begin()
+	if tx.Error == nil {
+		j.txs.txs[key] = tx
+		j.txs.order = append(j.txs.order, key)
+	}
+	return tx
+}
+
+// afterCommit registers fn to be run if the request commits
+func (t *txSet) afterCommit(fn func()) {
+	t.Lock()
+	defer t.Unlock()
+	t.done = append(t.done, fn)
+}
+
+func (t *txSet) commit() error {
+	t.Lock()
+	var err error
+	for i, key := range t.order {
+		if err = t.txs[key].Commit().Error; err != nil {
+			// roll back whatever is left
+			for _, k := range t.order[i+1:] {
+				t.txs[k].Rollback()
+			}
+			break
+		}
+	}
+	done := t.done
+	t.reset()
+	t.Unlock()
+
+	if err == nil {
+		for _, fn := range done {
+			fn()
+		}
+	}
+	return err
+}
+
+func (t *txSet) rollback() {
+	t.Lock()
+	defer t.Unlock()
+	for _, key := range t.order {
+		t.txs[key].Rollback()
+	}
+	t.reset()
+}
+
+func (t *txSet) reset() {
+	t.txs = make(map[string]*gorm.DB)
+	t.order = t.order[:0]
+	t.done = nil
+}
+
+// failed checks if the outputs of a handler indicate a failure
+func failed(out []reflect.Value, signs []string) bool {
+	for i, v := range out {
+		if signs[i] == "int" {
+			if code := v.Int(); code < 200 || code > 299 {
+				return true
+			}
+			continue
+		}
+		switch v.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			if v.IsNil() {
+				continue
+			}
+		}
+		if isError(v.Interface()) {
+			return true
+		}
+	}
+	return false
+}
+
+// invoke calls the user's method, and then settles the transactions that
+// were opened through the Aide
+func (e *endPoint) invoke(ref []reflect.Value, j *Aide) (out []reflect.Value, err error) {
+	if j == nil {
+		return e.exec.Do(ref), nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			j.txs.rollback()
+			panic(r)
+		}
+	}()
+
+	out = e.exec.Do(ref)
+	if failed(out, e.exec.outParams) {
+		j.txs.rollback()
+		return out, nil
+	}
+	return out, j.txs.commit()
+}
+
+func writeTxFault(w http.ResponseWriter, r *http.Request, err error, pretty string) {
+	f := Fault{
+		HTTPCode: 500,
+		Message:  "Could not commit transaction",
+		Issue:    err,
+	}
+	writeItem(w, r, refl.ObjSignature(f), reflect.ValueOf(f), pretty)
+}
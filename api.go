@@ -3,14 +3,14 @@ package aqua
 import (
 	"encoding/json"
 	"errors"
-	"strconv"
+	"reflect"
 	"strings"
 	"time"
 
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/jinzhu/gorm"
 	"github.com/mayur-tolexo/aero/db/cstr"
-	"github.com/mayur-tolexo/aero/db/orm"
 	"github.com/mayur-tolexo/aero/ds"
-	"github.com/mayur-tolexo/aero/engine"
 	"github.com/mayur-tolexo/aero/refl"
 )
 
@@ -26,6 +26,52 @@ type CRUD struct {
 	Api
 	cstr.Storage
 	Model func() (interface{}, interface{})
+
+	// nesting under a parent resource, and the associations
+	// that can be preloaded with ?include=
+	Parent  Parent
+	Include []string
+
+	// columns that can be filtered, ordered, grouped and aggregated on
+	Columns []string
+
+	// soft delete rows (needs a DeletedAt column), and the claim
+	// expression the principal must match for the admin view and restore
+	SoftDelete bool
+	Admin      string
+
+	// connections (of the same engine) that reads are spread over, and how
+	// long a client's reads stay on the primary after it writes
+	Replicas       []string
+	ReadYourWrites time.Duration
+
+	// key prefix used by the key value engines (redis)
+	Namespace string
+
+	// json file with an array of models to load into the memory engine
+	Seed string
+
+	// sink that the writes are recorded to (see AuditTable, AuditFile
+	// and AuditFunc)
+	Audit AuditSink
+
+	// service that declared the CRUD field (used for hooks)
+	svc  interface{}
+	auth Authorizer
+
+	// root and url of the crud, which name it in the audit trail
+	resource string
+
+	// told of the entries the Audit sink failed to record
+	auditFailed AuditFailureFunc
+
+	// expiry of stored values, parsed from the Ttl of the fixture
+	ttl time.Duration
+
+	// connection pool of the memcache engine
+	memc *memcache.Client
+
+	replicas *replicaSet
 }
 
 // If DB infomraiton was not set by user, then try to use the master
@@ -43,7 +89,7 @@ func (c *CRUD) validate() {
 		panic("Crud storage conn not spefieid")
 	}
 
-	if c.getMethod("create") == "Rdbms_Create" { // Model is a must
+	if meth := c.getMethod("create"); meth == "Rdbms_Create" || meth == "Memory_Create" { // Model is a must
 		if c.Model == nil {
 			panic("Model not specified")
 		}
@@ -60,6 +106,47 @@ func (c *CRUD) validate() {
 				panic("Model() method param 2 must be address of a slice of gorm struct")
 			}
 		}
+		c.validateParent(m)
+		c.validateKeys(m)
+		validateColumns(m, c.Columns)
+		c.validateSoftDelete(m)
+
+		if c.Engine == "memory" {
+			c.validateMemory(m)
+		}
+	}
+
+	c.validateReplicas()
+	c.validateAudit()
+
+	if c.Engine == "memcache" {
+		c.validateMemcache()
+	}
+
+	if c.Engine == "redis" {
+		validateRedisConn(c.Conn)
+		if c.Ttl != "" {
+			ttl, err := time.ParseDuration(c.Ttl)
+			if err != nil || ttl < 0 {
+				panic("Crud ttl is not a valid duration: " + c.Ttl)
+			}
+			c.ttl = ttl
+		}
+		if c.Model != nil {
+			m, arr := c.Model()
+			if !strings.HasPrefix(refl.ObjSignature(m), "*st:") {
+				panic("Model() method param 1 must be address of a struct")
+			}
+			if !strings.HasPrefix(refl.ObjSignature(arr), "*sl:") {
+				panic("Model() method param 2 must be address of a slice of struct")
+			}
+			if _, err := primaryField(m); err != nil {
+				panic(err.Error())
+			}
+			if keyVars(m) != nil {
+				panic("Crud redis models need a single key field")
+			}
+		}
 	}
 }
 
@@ -80,6 +167,36 @@ func (c *CRUD) getMethod(action string) string {
 			return "Rdbms_FetchSql"
 		case "sqlJson":
 			return "Rdbms_FetchSqlJson"
+		case "list":
+			return "Rdbms_List"
+		case "aggregate":
+			return "Rdbms_Aggregate"
+		case "restore":
+			return "Rdbms_Restore"
+		case "export":
+			return "Rdbms_Export"
+		case "import":
+			return "Rdbms_Import"
+		}
+
+	case "memory":
+		switch action {
+		case "create":
+			return "Memory_Create"
+		case "read":
+			return "Memory_Read"
+		case "update":
+			return "Memory_Update"
+		case "delete":
+			return "Memory_Delete"
+		case "list":
+			return "Memory_List"
+		case "aggregate":
+			return "Memory_Aggregate"
+		case "export":
+			return "Memory_Export"
+		case "import":
+			return "Memory_Import"
 		}
 
 	case "memcache":
@@ -91,17 +208,98 @@ func (c *CRUD) getMethod(action string) string {
 		case "delete":
 			return "Memcache_Delete"
 		}
+
+	case "redis":
+		switch action {
+		case "read":
+			return "Redis_Read"
+		case "update":
+			return "Redis_Update"
+		case "delete":
+			return "Redis_Delete"
+		case "create":
+			if c.Model != nil {
+				return "Redis_Create"
+			}
+		case "list":
+			if c.Model != nil {
+				return "Redis_List"
+			}
+		}
 	}
 
 	return ""
 }
 
-func (c *CRUD) Rdbms_Read(primKey string) interface{} {
+// crudOps lists the op (as used in the ops tag) and the verb (as used in
+// allow_read, allow_write and allow_delete) of each crud action
+var crudOps = map[string][2]string{
+	"read":      {"read", "read"},
+	"create":    {"create", "write"},
+	"update":    {"update", "write"},
+	"delete":    {"delete", "delete"},
+	"restore":   {"restore", "write"},
+	"list":      {"list", "read"},
+	"aggregate": {"aggregate", "read"},
+	"sql":       {"query", "read"},
+	"sqlJson":   {"query", "read"},
+	"export":    {"export", "read"},
+	"import":    {"import", "write"},
+}
+
+func validateOps(ops string) {
+	if ops == "" {
+		return
+	}
+	for _, o := range strings.Split(ops, ",") {
+		o = strings.TrimSpace(o)
+		found := false
+		for _, v := range crudOps {
+			if v[0] == o {
+				found = true
+			}
+		}
+		if !found {
+			panic("Unknown crud op: " + o)
+		}
+	}
+}
+
+// selectFields limits the columns read to the fields asked for via ?fields=
+func (c *CRUD) selectFields(db *gorm.DB, m interface{}, j Aide) (*gorm.DB, error) {
+	fields := requestedFields(j.Request)
+	if fields == nil {
+		return db, nil
+	}
+	cols, err := planOf(reflect.TypeOf(m)).columns(fields, principalOf(j.Request))
+	if err != nil {
+		return nil, err
+	}
+	return db.Select(cols), nil
+}
+
+func (c *CRUD) Rdbms_Read(primKey string, j Aide) interface{} {
 	m, _ := c.Model()
 
-	dbo := orm.GetConn(c.Engine, c.Conn)
+	dbo := c.readConn(j)
 
-	if err := dbo.First(m, primKey).Error; err != nil {
+	qry, err := c.preload(c.withDeleted(c.scope(dbo, j), j), j)
+	if err != nil {
+		return err
+	}
+	if qry, err = c.selectFields(qry, m, j); err != nil {
+		return err
+	}
+	if qry, err = c.whereKey(qry, m, primKey); err != nil {
+		return err
+	}
+	if err := qry.First(m).Error; err != nil {
+		return err
+	}
+
+	h := c.newHook(j, m, dbo)
+	h.Pkey = primKey
+	if err := c.hook("afterRead", h); err != nil {
 		return err
 	}
 	return m
@@ -116,27 +314,71 @@ func (c *CRUD) Rdbms_Create(j Aide) interface{} {
 	if err != nil {
 		return err
 	}
+	planOf(reflect.TypeOf(m)).scrub(m)
+	if err = c.adopt(m, j); err != nil {
+		return err
+	}
 
-	dbo := orm.GetConn(c.Engine, c.Conn)
+	var rows int64
+	err = c.inTx(j, func(tx *gorm.DB) error {
+		h := c.newHook(j, m, tx)
+		if err := c.hook("beforeCreate", h); err != nil {
+			return err
+		}
 
-	stmt := dbo.Create(m)
+		stmt := tx.Create(m)
+		if stmt.Error != nil {
+			return stmt.Error
+		}
+		rows = stmt.RowsAffected
 
-	if stmt.Error != nil {
-		return stmt.Error
+		return c.hook("afterCreate", h)
+	})
+	if err != nil {
+		return err
 	}
 
-	return map[string]interface{}{"rows_affected": stmt.RowsAffected, "success": 1}
+	c.audit(j, "create", keyString(m), nil, auditValues(m))
+	c.pin(j)
+	return map[string]interface{}{"rows_affected": rows, "success": 1}
 }
 
-func (c *CRUD) Rdbms_Delete(primKey string) interface{} {
+func (c *CRUD) Rdbms_Delete(primKey string, j Aide) interface{} {
 	m, _ := c.Model()
+	var before map[string]interface{}
+
+	err := c.inTx(j, func(tx *gorm.DB) error {
+		h := c.newHook(j, m, tx)
+		h.Pkey = primKey
+
+		// hooks (and the audit trail) get to see the row that is about
+		// to be deleted
+		qry, err := c.whereKey(c.scope(tx, j), m, primKey)
+		if err != nil {
+			return err
+		}
+		if c.hasHook(m, "beforeDelete", "afterDelete") || c.Audit != nil {
+			if err := qry.First(m).Error; err != nil {
+				return err
+			}
+			before = auditValues(m)
+		}
+		if err := c.hook("beforeDelete", h); err != nil {
+			return err
+		}
 
-	dbo := orm.GetConn(c.Engine, c.Conn)
+		if err := qry.Delete(m).Error; err != nil {
+			return err
+		}
 
-	if err := dbo.Where(primKey).Delete(m).Error; err != nil {
+		return c.hook("afterDelete", h)
+	})
+	if err != nil {
 		return err
 	}
 
+	c.audit(j, "delete", primKey, before, nil)
+	c.pin(j)
 	return map[string]interface{}{"success": 1}
 }
 
@@ -149,14 +391,63 @@ func (c *CRUD) Rdbms_Update(primKey string, j Aide) interface{} {
 		return err
 	}
 
-	dbo := orm.GetConn(c.Engine, c.Conn)
-
 	m, _ := c.Model()
+	var before, after map[string]interface{}
+
+	err = c.inTx(j, func(tx *gorm.DB) error {
+		h := c.newHook(j, m, tx)
+		h.Pkey = primKey
+		h.Data = data
+		planOf(reflect.TypeOf(m)).scrubData(h.Data)
+
+		// hooks (and the audit trail) get to see the row as it was
+		// before the update
+		qry, err := c.whereKey(c.scope(tx, j), m, primKey)
+		if err != nil {
+			return err
+		}
+		if c.hasHook(m, "beforeUpdate", "afterUpdate") || c.Audit != nil {
+			if err := qry.First(m).Error; err != nil {
+				return err
+			}
+			before = auditValues(m)
+		}
+		if err := c.hook("beforeUpdate", h); err != nil {
+			return err
+		}
 
-	if err := dbo.Model(m).Where(primKey).UpdateColumns(data).Error; err != nil {
+		// a nested row cannot be moved to another parent
+		if c.nested() {
+			for k := range h.Data {
+				if k == c.Parent.Column || k == gorm.ToDBName(c.Parent.Column) {
+					delete(h.Data, k)
+				}
+			}
+		}
+
+		if err := qry.Model(m).UpdateColumns(h.Data).Error; err != nil {
+			return err
+		}
+
+		if c.Audit != nil {
+			now, _ := c.Model()
+			if err := qry.First(now).Error; err != nil {
+				return err
+			}
+			after = auditValues(now)
+		}
+
+		return c.hook("afterUpdate", h)
+	})
+	if err != nil {
 		return err
 	}
 
+	if c.Audit != nil {
+		before, after = auditChanges(before, after)
+		c.audit(j, "update", primKey, before, after)
+	}
+	c.pin(j)
 	return map[string]interface{}{"success": 1}
 }
 
@@ -164,9 +455,16 @@ func (c *CRUD) Rdbms_FetchSql(j Aide) interface{} {
 	j.LoadVars()
 	m, col := c.Model()
 
-	dbo := orm.GetConn(c.Engine, c.Conn)
+	dbo := c.readConn(j)
 
-	if err := dbo.Model(m).Where(j.Body).Find(col).Error; err != nil {
+	qry, err := c.preload(c.withDeleted(c.scope(dbo.Model(m), j), j), j)
+	if err != nil {
+		return err
+	}
+	if qry, err = c.selectFields(qry, m, j); err != nil {
+		return err
+	}
+	if err := qry.Where(j.Body).Find(col).Error; err != nil {
 		return err
 	}
 	return col
@@ -248,9 +546,16 @@ func (c *CRUD) Rdbms_FetchSqlJson(j Aide) interface{} {
 	}
 
 	m, col := c.Model()
-	dbo := orm.GetConn(c.Engine, c.Conn)
+	dbo := c.readConn(j)
 
-	if err := dbo.Model(m).
+	qry, err := c.preload(c.withDeleted(c.scope(dbo.Model(m), j), j), j)
+	if err != nil {
+		return err
+	}
+	if qry, err = c.selectFields(qry, m, j); err != nil {
+		return err
+	}
+	if err := qry.
 		Where(whr, p...).
 		Order(ord).
 		Limit(lim).
@@ -262,71 +567,86 @@ func (c *CRUD) Rdbms_FetchSqlJson(j Aide) interface{} {
 	return col
 }
 
-func (c *CRUD) Memcache_Read(primKey string) interface{} {
+func (c *CRUD) Rdbms_List(j Aide) interface{} {
+	m, col := c.Model()
+	q := j.Request.URL.Query()
 
-	// Memcache object
-	spl := strings.Split(c.Conn, ":")
-	host := spl[0]
-	port, err := strconv.Atoi(spl[1])
+	fs, err := c.filters(m, q)
+	if err != nil {
+		return err
+	}
+	ord, err := c.order(m, q)
+	if err != nil {
+		return err
+	}
+	lim, off, err := page(q)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	memc := engine.NewMemcache(host, port)
-	defer memc.Close()
 
-	data, err := memc.Get(primKey)
+	dbo := c.readConn(j)
+
+	qry, err := c.preload(c.withDeleted(c.scope(dbo.Model(m), j), j), j)
+	if err != nil {
+		return err
+	}
+	if qry, err = c.selectFields(qry, m, j); err != nil {
+		return err
+	}
+	for _, f := range fs {
+		qry = f.apply(qry)
+	}
+	if ord != "" {
+		qry = qry.Order(ord)
+	}
 
-	if err == nil {
-		return string(data)
-	} else {
+	if err := qry.Limit(lim).Offset(off).Find(col).Error; err != nil {
 		return err
 	}
+	return col
 }
 
-func (c *CRUD) Memcache_Update(primKey string, j Aide) interface{} {
+func (c *CRUD) Rdbms_Aggregate(j Aide) interface{} {
+	m, _ := c.Model()
+	q := j.Request.URL.Query()
 
-	// Memcache object
-	spl := strings.Split(c.Conn, ":")
-	host := spl[0]
-	port, err := strconv.Atoi(spl[1])
+	fs, err := c.filters(m, q)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	memc := engine.NewMemcache(host, port)
-	defer memc.Close()
-
-	ttl, err := time.ParseDuration(c.Ttl)
+	aggs, err := c.aggregates(m, q)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	if ttl == 0 {
-		panic("ttl cache duration should not be 0")
+	grps, err := c.groups(m, q)
+	if err != nil {
+		return err
 	}
 
-	j.LoadVars()
-	memc.Set(primKey, []byte(j.Body), ttl)
+	sel := append([]string{}, grps...)
+	for _, a := range aggs {
+		sel = append(sel, a.sql())
+	}
 
-	return ""
-}
+	dbo := c.readConn(j)
 
-func (c *CRUD) Memcache_Delete(primKey string, j Aide) interface{} {
+	qry := c.withDeleted(c.scope(dbo.Model(m), j), j).Select(strings.Join(sel, ", "))
+	for _, f := range fs {
+		qry = f.apply(qry)
+	}
+	if len(grps) > 0 {
+		qry = qry.Group(strings.Join(grps, ", ")).Order(strings.Join(grps, ", "))
+	}
 
-	// Memcache object
-	spl := strings.Split(c.Conn, ":")
-	host := spl[0]
-	port, err := strconv.Atoi(spl[1])
+	rows, err := qry.Rows()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	memc := engine.NewMemcache(host, port)
-	defer memc.Close()
-
-	err = memc.Delete(primKey)
-
+	out, err := scanRows(rows, aggs)
 	if err != nil {
 		return err
 	}
-	return ""
+	return out
 }
 
 // TODO: write test cases for CRUD and fetch methods
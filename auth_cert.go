@@ -0,0 +1,81 @@
+package aqua
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// CertAuth is an Authorizer for clients that present a certificate verified
+// by the server (see Tls.ClientCAs). The certificate is read as claims, so
+// that the allow and deny tags can match it:
+//
+//	cn   the common name of the subject, e.g. allow:"cn:billing-service"
+//	san  the dns names, uris, emails and ips of the certificate
+//	o    the organizations of the subject
+//	ou   the organizational units of the subject
+//
+// The common name is the principal of the request, or else the first san.
+type CertAuth struct{}
+
+var errNoCert = errors.New("client certificate missing")
+
+func (a CertAuth) Authorize(r *http.Request, allow string, deny string) bool {
+	_, err := a.Identify(r, allow, deny)
+	return err == nil
+}
+
+// Identify authorizes the request by its verified client certificate
+func (a CertAuth) Identify(r *http.Request, allow string, deny string) (Principal, error) {
+	cert := ClientCert(r)
+	if cert == nil {
+		if anonymousOk(allow, deny) {
+			return Principal{}, nil
+		}
+		return Principal{}, Unauthenticated("Certificate", errNoCert)
+	}
+	claims := certClaims(cert)
+	p := Principal{Id: fmt.Sprint(claims["sub"]), Roles: make([]string, 0), Claims: claims}
+	if matchExpr(claims, deny) || !(public(allow) || matchExpr(claims, allow)) {
+		return p, Forbidden(errAccessDenied)
+	}
+	return p, nil
+}
+
+// ClientCert returns the client certificate of a request, if the server has
+// verified it, and nil otherwise
+func ClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// ClientCert returns the verified client certificate of the request, if any
+func (j Aide) ClientCert() *x509.Certificate {
+	return ClientCert(j.Request)
+}
+
+func certClaims(c *x509.Certificate) map[string]interface{} {
+	san := make([]string, 0)
+	san = append(san, c.DNSNames...)
+	san = append(san, c.EmailAddresses...)
+	for _, u := range c.URIs {
+		san = append(san, u.String())
+	}
+	for _, ip := range c.IPAddresses {
+		san = append(san, ip.String())
+	}
+	sub := c.Subject.CommonName
+	if sub == "" && len(san) > 0 {
+		sub = san[0]
+	}
+	return map[string]interface{}{
+		"sub": sub,
+		"cn":  c.Subject.CommonName,
+		"san": san,
+		"o":   c.Subject.Organization,
+		"ou":  c.Subject.OrganizationalUnit,
+	}
+}
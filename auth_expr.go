@@ -0,0 +1,112 @@
+package aqua
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The allow and deny tags are read by the built-in authorizers as lists of
+// claim expressions separated by commas, any one of which has to hold:
+//
+//   any                 anyone, even without credentials (allow only)
+//   authenticated       any caller with valid credentials
+//   role:admin          the role (or roles) claim holds admin
+//   scope:orders.write  the scope (space separated) or scp claim holds orders.write
+//   <claim>:<value>     the claim equals value, or is a list that holds it
+//
+// An empty allow lets anyone through, an empty deny turns no one away.
+
+// public checks if an allow expression lets in callers without credentials
+func public(allow string) bool {
+	for _, e := range splitExpr(allow) {
+		if e == "any" {
+			return true
+		}
+	}
+	return strings.TrimSpace(allow) == ""
+}
+
+// anonymousOk checks if callers without credentials can be let through, that
+// is if allow lets them in and deny does not turn anyone away
+func anonymousOk(allow, deny string) bool {
+	return public(allow) && strings.TrimSpace(deny) == ""
+}
+
+// matchExpr checks if any of the expressions holds for the given claims
+func matchExpr(claims map[string]interface{}, expr string) bool {
+	for _, e := range splitExpr(expr) {
+		if matchClaim(claims, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitExpr(expr string) []string {
+	out := make([]string, 0)
+	for _, e := range strings.Split(expr, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func matchClaim(claims map[string]interface{}, e string) bool {
+	switch e {
+	case "any", "authenticated":
+		return true
+	}
+	kv := strings.SplitN(e, ":", 2)
+	if len(kv) != 2 {
+		return false
+	}
+	name, want := kv[0], kv[1]
+
+	names := []string{name}
+	switch name {
+	case "role":
+		names = []string{"role", "roles"}
+	case "scope":
+		names = []string{"scope", "scp"}
+	}
+	for _, n := range names {
+		if holds(claims[n], want, name == "scope") {
+			return true
+		}
+	}
+	return false
+}
+
+// holds checks if a claim value is (or contains) want
+func holds(v interface{}, want string, spaced bool) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case string:
+		if spaced {
+			for _, s := range strings.Fields(t) {
+				if s == want {
+					return true
+				}
+			}
+			return false
+		}
+		return t == want
+	case []string:
+		for _, s := range t {
+			if s == want {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, s := range t {
+			if holds(s, want, false) {
+				return true
+			}
+		}
+	default:
+		return fmt.Sprint(t) == want
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package aqua
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HmacAuth is an Authorizer for signed requests, made by partners that share
+// a secret with us. A request carries its signature in the header
+//
+//	Authorization: HMAC-SHA256 key="partner1", ts="1700000000", nonce="...", sig="..."
+//
+// where sig is the base64 hmac-sha256 of the canonical request (see
+// canonicalRequest): the method, the path, the sorted query, ts, nonce, the
+// Headers and the sha256 of the body. Requests older or newer than Window (5m
+// by default) are refused, and so is a nonce that was seen before. SignRequest
+// signs requests for Go clients.
+//
+// The key id is the principal of the request, and can be matched by the allow
+// and deny tags as sub:<key>.
+type HmacAuth struct {
+	Keys    map[string][]byte
+	Headers []string
+	Window  time.Duration
+	Nonces  NonceStore
+	MaxBody int64
+
+	once sync.Once
+}
+
+// NonceStore remembers the nonces of signed requests. Use returns false for a
+// nonce that was already used; the nonce need not be kept beyond until.
+type NonceStore interface {
+	Use(nonce string, until time.Time) bool
+}
+
+const hmacScheme = "HMAC-SHA256"
+
+var (
+	errNoSignature  = errors.New("request signature missing")
+	errBadSignature = errors.New("invalid request signature")
+	errStale        = errors.New("request timestamp outside the allowed window")
+	errReplay       = errors.New("request nonce already used")
+)
+
+func (a *HmacAuth) Authorize(r *http.Request, allow string, deny string) bool {
+	_, err := a.Identify(r, allow, deny)
+	return err == nil
+}
+
+// Identify verifies the signature of the request and returns its key as the
+// principal
+func (a *HmacAuth) Identify(r *http.Request, allow string, deny string) (Principal, error) {
+	id, err := a.verify(r)
+	if err != nil {
+		if err == errNoSignature && anonymousOk(allow, deny) {
+			return Principal{}, nil
+		}
+		if f, ok := err.(Fault); ok {
+			return Principal{}, f
+		}
+		return Principal{}, Unauthenticated(hmacScheme, err)
+	}
+	claims := map[string]interface{}{"sub": id}
+	p := Principal{Id: id, Roles: make([]string, 0), Claims: claims}
+	if matchExpr(claims, deny) || !(public(allow) || matchExpr(claims, allow)) {
+		return p, Forbidden(errAccessDenied)
+	}
+	return p, nil
+}
+
+func (a *HmacAuth) window() time.Duration {
+	if a.Window <= 0 {
+		return 5 * time.Minute
+	}
+	return a.Window
+}
+
+// verify checks the signature of the request and returns its key id
+func (a *HmacAuth) verify(r *http.Request) (string, error) {
+	a.once.Do(func() {
+		if a.Nonces == nil {
+			a.Nonces = MemoryNonces()
+		}
+	})
+
+	params, err := hmacParams(r.Header.Get("Authorization"))
+	if err != nil {
+		return "", err
+	}
+	secret, found := a.Keys[params["key"]]
+	if !found {
+		return "", errBadSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["sig"])
+	if err != nil {
+		return "", errBadSignature
+	}
+	ts, err := strconv.ParseInt(params["ts"], 10, 64)
+	if err != nil {
+		return "", errBadSignature
+	}
+	at := time.Unix(ts, 0)
+	if d := time.Since(at); d > a.window() || d < -a.window() {
+		return "", errStale
+	}
+
+	body, err := bufferBody(r, a.MaxBody)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonicalRequest(r, params["ts"], params["nonce"], a.Headers, body)))
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return "", errBadSignature
+	}
+
+	// nonces are checked last, so that they cannot be used up by forgeries
+	if !a.Nonces.Use(params["key"]+":"+params["nonce"], at.Add(a.window())) {
+		return "", errReplay
+	}
+	return params["key"], nil
+}
+
+// hmacParams parses the key="value" pairs of an HMAC-SHA256 authorization
+func hmacParams(h string) (map[string]string, error) {
+	if !strings.HasPrefix(h, hmacScheme+" ") {
+		return nil, errNoSignature
+	}
+	out := make(map[string]string)
+	for _, kv := range strings.Split(h[len(hmacScheme)+1:], ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) == 2 {
+			out[parts[0]] = strings.Trim(parts[1], `"`)
+		}
+	}
+	for _, k := range []string{"key", "ts", "nonce", "sig"} {
+		if out[k] == "" {
+			return nil, errBadSignature
+		}
+	}
+	return out, nil
+}
+
+// bufferBody reads the body of the request and puts it back, so that the
+// handler (or Aide.LoadVars) can read it again
+func bufferBody(r *http.Request, max int64) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	if max <= 0 {
+		max = 10 << 20
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, max))
+	r.Body.Close()
+	if err != nil {
+		return nil, Fault{
+			HTTPCode: http.StatusRequestEntityTooLarge,
+			Message:  "Request body too large",
+			Issue:    err,
+		}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+// canonicalRequest is the text that is signed:
+//
+//	METHOD \n /escaped/path \n a=1&b=2 \n ts \n nonce \n header:value \n ... \n hex(sha256(body))
+//
+// with the query sorted by name and value, and the headers named in lower case.
+func canonicalRequest(r *http.Request, ts string, nonce string, headers []string, body []byte) string {
+	q := r.URL.Query()
+	names := make([]string, 0, len(q))
+	for k := range q {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0)
+	for _, k := range names {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			pairs = append(pairs, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+
+	lines := []string{strings.ToUpper(r.Method), r.URL.EscapedPath(), strings.Join(pairs, "&"), ts, nonce}
+	for _, h := range headers {
+		lines = append(lines, strings.ToLower(h)+":"+strings.TrimSpace(r.Header.Get(h)))
+	}
+	sum := sha256.Sum256(body)
+	lines = append(lines, hex.EncodeToString(sum[:]))
+	return strings.Join(lines, "\n")
+}
+
+// SignRequest signs a request for an HmacAuth server that shares the secret
+// of the given key, over the given headers
+func SignRequest(r *http.Request, key string, secret []byte, headers ...string) error {
+	body, err := bufferBody(r, -1)
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := newUUID()
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonicalRequest(r, ts, nonce, headers, body)))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	r.Header.Set("Authorization", fmt.Sprintf(`%s key="%s", ts="%s", nonce="%s", sig="%s"`, hmacScheme, key, ts, nonce, sig))
+	return nil
+}
+
+type memNonces struct {
+	sync.Mutex
+	until map[string]time.Time
+	swept time.Time
+}
+
+// MemoryNonces returns a nonce store that lives as long as the process; with
+// several servers, use a shared store instead
+func MemoryNonces() NonceStore {
+	return &memNonces{until: make(map[string]time.Time), swept: time.Now()}
+}
+
+func (m *memNonces) Use(nonce string, until time.Time) bool {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	if now.Sub(m.swept) > time.Minute {
+		for n, t := range m.until {
+			if now.After(t) {
+				delete(m.until, n)
+			}
+		}
+		m.swept = now
+	}
+	if t, found := m.until[nonce]; found && !now.After(t) {
+		return false
+	}
+	m.until[nonce] = until
+	return true
+}
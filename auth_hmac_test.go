@@ -0,0 +1,155 @@
+package aqua
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type partnerService struct {
+	RestService
+	invoice POST `url:"/invoices" allow:"sub:acme"`
+}
+
+func (s *partnerService) Invoice(j Aide) string {
+	j.LoadVars()
+	return j.Principal().Id + " sent " + j.Body
+}
+
+func signed(method string, path string, body string, key string, secret string) *http.Request {
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	SignRequest(r, key, []byte(secret), "Content-Type")
+	return r
+}
+
+func TestHmacAuth(t *testing.T) {
+
+	Convey("Given an hmac authorizer", t, func() {
+		a := &HmacAuth{Keys: map[string][]byte{"acme": []byte("s3cret")}, Headers: []string{"Content-Type"}}
+
+		Convey("Then a signed request should be accepted", func() {
+			r := signed("POST", "/invoices?b=2&a=1&a=0", `{"total":10}`, "acme", "s3cret")
+			p, err := a.Identify(r, "sub:acme", "")
+			So(err, ShouldBeNil)
+			So(p.Id, ShouldEqual, "acme")
+
+			Convey("And its body should still be readable", func() {
+				b, _ := ioutil.ReadAll(r.Body)
+				So(string(b), ShouldEqual, `{"total":10}`)
+			})
+		})
+		Convey("Then a request should not be accepted twice", func() {
+			r := signed("GET", "/invoices", "", "acme", "s3cret")
+			So(a.Authorize(r, "authenticated", ""), ShouldBeTrue)
+			_, err := a.Identify(r, "authenticated", "")
+			So(err.(Fault).Issue, ShouldEqual, errReplay)
+		})
+		Convey("Then a request that was tampered with should be refused", func() {
+			for _, change := range []func(r *http.Request){
+				func(r *http.Request) { r.Method = "DELETE" },
+				func(r *http.Request) { r.URL.Path = "/refunds" },
+				func(r *http.Request) { r.URL.RawQuery = "a=2" },
+				func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") },
+				func(r *http.Request) { r.Body = ioutil.NopCloser(strings.NewReader(`{"total":99}`)) },
+			} {
+				r := signed("POST", "/invoices?a=1", `{"total":10}`, "acme", "s3cret")
+				change(r)
+				_, err := a.Identify(r, "authenticated", "")
+				So(err.(Fault).HTTPCode, ShouldEqual, 401)
+				So(err.(Fault).Issue, ShouldEqual, errBadSignature)
+			}
+		})
+		Convey("Then a wrong secret or key should be refused", func() {
+			So(a.Authorize(signed("GET", "/invoices", "", "acme", "guess"), "authenticated", ""), ShouldBeFalse)
+			So(a.Authorize(signed("GET", "/invoices", "", "other", "s3cret"), "authenticated", ""), ShouldBeFalse)
+		})
+		Convey("Then an old request should be refused", func() {
+			r := signed("GET", "/invoices", "", "acme", "s3cret")
+			old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+			h := r.Header.Get("Authorization")
+			i := strings.Index(h, `ts="`) + 4
+			r.Header.Set("Authorization", h[:i]+old+h[i+len(old):])
+			_, err := a.Identify(r, "authenticated", "")
+			So(err.(Fault).Issue, ShouldEqual, errStale)
+		})
+		Convey("Then a body over the limit should be refused", func() {
+			a.MaxBody = 4
+			_, err := a.Identify(signed("POST", "/invoices", `{"total":10}`, "acme", "s3cret"), "authenticated", "")
+			So(err.(Fault).HTTPCode, ShouldEqual, 413)
+		})
+		Convey("Then public endpoints should not need a signature", func() {
+			r, _ := http.NewRequest("GET", "/invoices", nil)
+			So(a.Authorize(r, "", ""), ShouldBeTrue)
+			_, err := a.Identify(r, "authenticated", "")
+			So(err.(Fault).challenge, ShouldEqual, "HMAC-SHA256")
+		})
+	})
+
+	Convey("Given a nonce store", t, func() {
+		n := MemoryNonces()
+		Convey("Then a nonce should be usable again once it has expired", func() {
+			So(n.Use("a", time.Now().Add(-time.Second)), ShouldBeTrue)
+			So(n.Use("a", time.Now().Add(time.Minute)), ShouldBeTrue)
+			So(n.Use("a", time.Now().Add(time.Minute)), ShouldBeFalse)
+		})
+	})
+
+	audit, _ := ioutil.TempFile("", "hmac-audit")
+	audit.Close()
+	defer os.Remove(audit.Name())
+
+	s := NewRestServer()
+	s.SetAuth(&HmacAuth{Keys: map[string][]byte{"acme": []byte("s3cret"), "zeta": []byte("z")}})
+	s.AddService(&partnerService{})
+	s.AddService(&stockService{file: audit.Name(), admin: "sub:acme"})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	Convey("Given a server that takes signed requests", t, func() {
+		url := fmt.Sprintf("http://localhost:%d/partner/invoices", s.Port)
+		send := func(key string, secret string) (int, string) {
+			r, _ := http.NewRequest("POST", url, strings.NewReader(`{"total":10}`))
+			SignRequest(r, key, []byte(secret))
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				return 0, err.Error()
+			}
+			defer resp.Body.Close()
+			b, _ := ioutil.ReadAll(resp.Body)
+			return resp.StatusCode, string(b)
+		}
+
+		Convey("Then the handler should read the body that was verified", func() {
+			code, body := send("acme", "s3cret")
+			So(code, ShouldEqual, 200)
+			So(body, ShouldEqual, `acme sent {"total":10}`)
+		})
+		Convey("Then other partners should be forbidden", func() {
+			code, _ := send("zeta", "z")
+			So(code, ShouldEqual, 403)
+		})
+		Convey("Then a signed admin request should pass the admin check too", func() {
+			entries := func(key string, secret string) int {
+				url := fmt.Sprintf("http://localhost:%d/aqua/audit?resource=key-stock/items", s.Port)
+				r, _ := http.NewRequest("GET", url, nil)
+				SignRequest(r, key, []byte(secret))
+				resp, err := http.DefaultClient.Do(r)
+				if err != nil {
+					return 0
+				}
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			So(entries("acme", "s3cret"), ShouldEqual, 200)
+			So(entries("zeta", "z"), ShouldEqual, 403)
+		})
+	})
+}
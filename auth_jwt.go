@@ -0,0 +1,368 @@
+package aqua
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JwtAuth is an Authorizer for bearer tokens (Authorization: Bearer <jwt>)
+// signed with HS256, using Secret, or with RS256 and ES256, using the keys
+// of a JWKS file or url. The JWKS is reloaded every Refresh (1h by default)
+// and whenever a token is signed with a key it does not know, so that keys
+// can be rotated. The allow and deny tags are read as claim expressions.
+//
+//	server.SetAuth(&aqua.JwtAuth{Jwks: "https://idp/.well-known/jwks.json", Issuer: "https://idp/"})
+type JwtAuth struct {
+	Secret   []byte
+	Jwks     string
+	Refresh  time.Duration
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+
+	mu       sync.RWMutex
+	keys     map[string]interface{}
+	loadedAt time.Time
+	triedAt  time.Time
+}
+
+// an unknown key triggers a reload of the JWKS at most this often
+var jwksRetryAfter = time.Minute
+
+var (
+	errNoToken     = errors.New("bearer token missing")
+	errBadToken    = errors.New("malformed token")
+	errBadSig      = errors.New("invalid token signature")
+	errUnknownKey  = errors.New("token signed with an unknown key")
+	errExpired     = errors.New("token expired")
+	errNotYetValid = errors.New("token not yet valid")
+	errBadIssuer   = errors.New("token issuer not accepted")
+	errBadAudience = errors.New("token audience not accepted")
+)
+
+func (a *JwtAuth) Authorize(r *http.Request, allow string, deny string) bool {
+	_, err := a.Identify(r, allow, deny)
+	return err == nil
+}
+
+// Identify authorizes the request and returns the caller of a valid token,
+// with the sub claim as id and the role (or roles) claim as roles
+func (a *JwtAuth) Identify(r *http.Request, allow string, deny string) (Principal, error) {
+	claims, err := a.verify(r)
+	if err != nil {
+		if anonymousOk(allow, deny) {
+			return Principal{}, nil
+		}
+		return Principal{}, Unauthenticated(bearerChallenge(err), err)
+	}
+	p := claimsPrincipal(claims)
+	if matchExpr(claims, deny) || !(public(allow) || matchExpr(claims, allow)) {
+		return p, Forbidden(errAccessDenied)
+	}
+	return p, nil
+}
+
+// bearerChallenge is the WWW-Authenticate of a token that was refused (rfc 6750)
+func bearerChallenge(err error) string {
+	if err == errNoToken {
+		return "Bearer"
+	}
+	return fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.Error())
+}
+
+func claimsPrincipal(claims map[string]interface{}) Principal {
+	p := Principal{Roles: make([]string, 0), Claims: claims}
+	if sub, ok := claims["sub"]; ok && sub != nil {
+		p.Id = fmt.Sprint(sub)
+	}
+	for _, n := range []string{"role", "roles"} {
+		switch v := claims[n].(type) {
+		case string:
+			p.Roles = append(p.Roles, v)
+		case []interface{}:
+			for _, r := range v {
+				p.Roles = append(p.Roles, fmt.Sprint(r))
+			}
+		}
+	}
+	return p
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// verify checks the token of the request and returns its claims
+func (a *JwtAuth) verify(r *http.Request) (map[string]interface{}, error) {
+	tok := bearerToken(r)
+	if tok == "" {
+		return nil, errNoToken
+	}
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return nil, errBadToken
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, errBadToken
+	}
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errBadToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errBadToken
+	}
+
+	key, err := a.key(hdr.Alg, hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if !verifySignature(hdr.Alg, key, parts[0]+"."+parts[1], sig) {
+		return nil, errBadSig
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifySignature(alg string, key interface{}, signed string, sig []byte) bool {
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(mac.Sum(nil), sig)
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		sum := sha256.Sum256([]byte(signed))
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		sum := sha256.Sum256([]byte(signed))
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, sum[:], r, s)
+	}
+	return false
+}
+
+func (a *JwtAuth) checkClaims(c map[string]interface{}) error {
+	now := time.Now()
+	if exp, ok := c["exp"].(float64); ok && now.After(unixTime(exp).Add(a.Leeway)) {
+		return errExpired
+	}
+	if nbf, ok := c["nbf"].(float64); ok && now.Add(a.Leeway).Before(unixTime(nbf)) {
+		return errNotYetValid
+	}
+	if a.Issuer != "" && c["iss"] != a.Issuer {
+		return errBadIssuer
+	}
+	if a.Audience != "" && !holds(c["aud"], a.Audience, false) {
+		return errBadAudience
+	}
+	return nil
+}
+
+func unixTime(f float64) time.Time {
+	return time.Unix(int64(f), 0)
+}
+
+// key returns the key that verifies tokens of the given alg and key id
+func (a *JwtAuth) key(alg string, kid string) (interface{}, error) {
+	switch alg {
+	case "HS256":
+		if len(a.Secret) == 0 {
+			return nil, errUnknownKey
+		}
+		return a.Secret, nil
+	case "RS256", "ES256":
+	default:
+		return nil, fmt.Errorf("token alg %q not accepted", alg)
+	}
+	if a.Jwks == "" {
+		return nil, errUnknownKey
+	}
+
+	refresh := a.Refresh
+	if refresh <= 0 {
+		refresh = time.Hour
+	}
+	a.mu.RLock()
+	k := a.find(alg, kid)
+	stale := time.Since(a.loadedAt) > refresh
+	retry := time.Since(a.triedAt) >= jwksRetryAfter
+	a.mu.RUnlock()
+
+	if (k == nil || stale) && retry {
+		a.reload()
+		a.mu.RLock()
+		k = a.find(alg, kid)
+		a.mu.RUnlock()
+	}
+	if k == nil {
+		return nil, errUnknownKey
+	}
+	return k, nil
+}
+
+// find looks up a key by id; without an id, a lone key of the right type will do
+func (a *JwtAuth) find(alg string, kid string) interface{} {
+	fits := func(k interface{}) bool {
+		switch k.(type) {
+		case *rsa.PublicKey:
+			return alg == "RS256"
+		case *ecdsa.PublicKey:
+			return alg == "ES256"
+		}
+		return false
+	}
+	if kid != "" {
+		if k, found := a.keys[kid]; found && fits(k) {
+			return k
+		}
+		return nil
+	}
+	var out interface{}
+	for _, k := range a.keys {
+		if fits(k) {
+			if out != nil {
+				return nil
+			}
+			out = k
+		}
+	}
+	return out
+}
+
+func (a *JwtAuth) reload() {
+	a.mu.Lock()
+	a.triedAt = time.Now()
+	a.mu.Unlock()
+
+	keys, err := loadJwks(a.Jwks)
+	if err != nil {
+		log.Println("aqua: jwks could not be loaded:", err)
+		return
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.loadedAt = time.Now()
+	a.mu.Unlock()
+}
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// loadJwks reads a JWKS from a file or an http(s) url
+func loadJwks(src string) (map[string]interface{}, error) {
+	var b []byte
+	var err error
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		resp, err := jwksClient.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("%s returned %d", src, resp.StatusCode)
+		}
+		if b, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else if b, err = ioutil.ReadFile(src); err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]interface{})
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		kid := k.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("#%d", i)
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("bad rsa key %s", kid)
+			}
+			out[kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("bad ec key %s", kid)
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, fmt.Errorf("bad ec key %s", kid)
+			}
+			out[kid] = pub
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,291 @@
+package aqua
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// signJwt creates a token for the tests
+func signJwt(alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := b64(hdr) + "." + b64(body)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, sum[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + b64(sig)
+}
+
+func jwks(keys map[string]interface{}) string {
+	out := make([]map[string]string, 0)
+	for kid, k := range keys {
+		switch p := k.(type) {
+		case *rsa.PrivateKey:
+			out = append(out, map[string]string{"kty": "RSA", "kid": kid,
+				"n": b64(p.N.Bytes()), "e": b64(big.NewInt(int64(p.E)).Bytes())})
+		case *ecdsa.PrivateKey:
+			out = append(out, map[string]string{"kty": "EC", "kid": kid, "crv": "P-256",
+				"x": b64(p.X.FillBytes(make([]byte, 32))), "y": b64(p.Y.FillBytes(make([]byte, 32)))})
+		}
+	}
+	b, _ := json.Marshal(map[string]interface{}{"keys": out})
+	return string(b)
+}
+
+func bearer(tok string) *http.Request {
+	r, _ := http.NewRequest("GET", "/orders", nil)
+	if tok != "" {
+		r.Header.Set("Authorization", "Bearer "+tok)
+	}
+	return r
+}
+
+func TestJwtAuth(t *testing.T) {
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	secret := []byte("s3cret")
+
+	f, _ := ioutil.TempFile("", "jwks")
+	f.WriteString(jwks(map[string]interface{}{"r1": rsaKey, "e1": ecKey}))
+	f.Close()
+	defer os.Remove(f.Name())
+
+	hour := time.Now().Add(time.Hour).Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "u1", "iss": "idp", "aud": []string{"api"}, "exp": hour,
+			"roles": []string{"admin"}, "scope": "orders.read orders.write"}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	Convey("Given a JWT authorizer", t, func() {
+		a := &JwtAuth{Secret: secret, Jwks: f.Name(), Issuer: "idp", Audience: "api"}
+
+		Convey("Then tokens signed with HS256, RS256 and ES256 should be accepted", func() {
+			So(a.Authorize(bearer(signJwt("HS256", "", secret, claims(nil))), "role:admin", ""), ShouldBeTrue)
+			So(a.Authorize(bearer(signJwt("RS256", "r1", rsaKey, claims(nil))), "role:admin", ""), ShouldBeTrue)
+			So(a.Authorize(bearer(signJwt("ES256", "e1", ecKey, claims(nil))), "role:admin", ""), ShouldBeTrue)
+		})
+		Convey("Then allow and deny should be read as claim expressions", func() {
+			tok := bearer(signJwt("RS256", "r1", rsaKey, claims(nil)))
+			So(a.Authorize(tok, "scope:orders.write", ""), ShouldBeTrue)
+			So(a.Authorize(tok, "scope:orders.delete", ""), ShouldBeFalse)
+			So(a.Authorize(tok, "role:root,sub:u1", ""), ShouldBeTrue)
+			So(a.Authorize(tok, "authenticated", "role:admin"), ShouldBeFalse)
+		})
+		Convey("Then public endpoints should not need a token", func() {
+			So(a.Authorize(bearer(""), "", ""), ShouldBeTrue)
+			So(a.Authorize(bearer(""), "any", ""), ShouldBeTrue)
+			So(a.Authorize(bearer(""), "authenticated", ""), ShouldBeFalse)
+		})
+		Convey("Then bad tokens should be refused", func() {
+			other, _ := rsa.GenerateKey(rand.Reader, 1024)
+			for _, tok := range []string{
+				"not.a.token",
+				signJwt("RS256", "r1", other, claims(nil)),
+				signJwt("HS256", "", []byte("wrong"), claims(nil)),
+				signJwt("none", "", nil, claims(nil)),
+				signJwt("RS256", "r1", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})),
+				signJwt("RS256", "r1", rsaKey, claims(map[string]interface{}{"nbf": hour})),
+				signJwt("RS256", "r1", rsaKey, claims(map[string]interface{}{"iss": "other"})),
+				signJwt("RS256", "r1", rsaKey, claims(map[string]interface{}{"aud": "web"})),
+			} {
+				So(a.Authorize(bearer(tok), "authenticated", ""), ShouldBeFalse)
+			}
+		})
+		Convey("Then the leeway should allow for clock skew", func() {
+			a.Leeway = 2 * time.Minute
+			tok := signJwt("RS256", "r1", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}))
+			So(a.Authorize(bearer(tok), "authenticated", ""), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a JWKS served over http", t, func() {
+		keys := map[string]interface{}{"r1": rsaKey}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(jwks(keys)))
+		}))
+		defer srv.Close()
+
+		saved := jwksRetryAfter
+		jwksRetryAfter = 0
+		defer func() { jwksRetryAfter = saved }()
+
+		a := &JwtAuth{Jwks: srv.URL}
+
+		Convey("Then a rotated key should be picked up", func() {
+			So(a.Authorize(bearer(signJwt("RS256", "r1", rsaKey, claims(nil))), "authenticated", ""), ShouldBeTrue)
+
+			rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+			tok := bearer(signJwt("RS256", "r2", rotated, claims(nil)))
+			So(a.Authorize(tok, "authenticated", ""), ShouldBeFalse)
+
+			keys["r2"] = rotated
+			So(a.Authorize(tok, "authenticated", ""), ShouldBeTrue)
+		})
+	})
+}
+
+type whoService struct {
+	RestService
+	me     GET `url:"/me" allow:"authenticated"`
+	status GET `url:"/status"`
+	admin  GET `url:"/admin" allow:"role:root"`
+}
+
+func (s *whoService) Me(j Aide) string {
+	return j.Principal().Id
+}
+
+func (s *whoService) Admin(j Aide) string {
+	return "root"
+}
+
+func (s *whoService) Status(j Aide) string {
+	return "hello " + j.Principal().Id
+}
+
+func TestIdentity(t *testing.T) {
+
+	secret := []byte("s3cret")
+	a := &JwtAuth{Secret: secret}
+	hour := time.Now().Add(time.Hour).Unix()
+	tok := signJwt("HS256", "", secret, map[string]interface{}{"sub": "u7", "exp": hour, "roles": []string{"ops", "admin"}})
+
+	Convey("Given a JWT authorizer", t, func() {
+
+		Convey("Then the caller of a valid token should be identified", func() {
+			p, err := a.Identify(bearer(tok), "role:ops", "")
+			So(err, ShouldBeNil)
+			So(p.Id, ShouldEqual, "u7")
+			So(p.Roles, ShouldResemble, []string{"ops", "admin"})
+			So(p.Claims["sub"], ShouldEqual, "u7")
+		})
+		Convey("Then a bad token should be told apart from a caller that is not allowed", func() {
+			_, err := a.Identify(bearer(""), "authenticated", "")
+			So(err.(Fault).HTTPCode, ShouldEqual, 401)
+			So(err.(Fault).challenge, ShouldEqual, "Bearer")
+			_, err = a.Identify(bearer(signJwt("HS256", "", []byte("wrong"), nil)), "authenticated", "")
+			So(err.(Fault).challenge, ShouldContainSubstring, `error="invalid_token"`)
+			p, err := a.Identify(bearer(tok), "role:root", "")
+			So(err.(Fault).HTTPCode, ShouldEqual, 403)
+			So(p.Id, ShouldEqual, "u7")
+			_, err = a.Identify(bearer(tok), "", "role:ops")
+			So(err.(Fault).HTTPCode, ShouldEqual, 403)
+		})
+		Convey("Then a caller without a token should be anonymous", func() {
+			p, err := a.Identify(bearer(""), "", "")
+			So(err, ShouldBeNil)
+			So(p.Authenticated(), ShouldBeFalse)
+		})
+	})
+
+	failed := make(chan string, 10)
+	s := NewRestServer()
+	s.SetAuth(a)
+	s.SetAuthFailureHook(func(r *http.Request, f Fault) {
+		failed <- fmt.Sprintf("%s %d %s", r.URL.Path, f.HTTPCode, principalOf(r).Id)
+	})
+	s.AddService(&whoService{})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	call := func(path string, tok string) *http.Response {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/who%s", s.Port, path), nil)
+		if tok != "" {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+		resp, _ := http.DefaultClient.Do(req)
+		return resp
+	}
+	get := func(path string, tok string) (int, string) {
+		resp := call(path, tok)
+		if resp == nil {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	Convey("Given a server with an identity authorizer", t, func() {
+
+		Convey("Then handlers should see the principal", func() {
+			code, body := get("/me", tok)
+			So(code, ShouldEqual, 200)
+			So(body, ShouldEqual, "u7")
+			code, _ = get("/me", "")
+			So(code, ShouldEqual, 401)
+			So(<-failed, ShouldEqual, "/who/me 401 ")
+		})
+		Convey("Then public endpoints should see the principal too", func() {
+			_, body := get("/status", tok)
+			So(body, ShouldEqual, "hello u7")
+			_, body = get("/status", "")
+			So(body, ShouldEqual, "hello ")
+		})
+		Convey("Then a caller without credentials should be challenged", func() {
+			resp := call("/me", "")
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, 401)
+			So(resp.Header.Get("WWW-Authenticate"), ShouldEqual, "Bearer")
+			So(<-failed, ShouldEqual, "/who/me 401 ")
+		})
+		Convey("Then a caller that is not allowed should be forbidden", func() {
+			code, body := get("/admin", tok)
+			So(code, ShouldEqual, 403)
+			So(body, ShouldContainSubstring, `"message":"Forbidden"`)
+			So(<-failed, ShouldEqual, "/who/admin 403 u7")
+		})
+	})
+
+	Convey("Given cached responses", t, func() {
+		r := bearer("")
+		r.RequestURI = "/orders"
+
+		Convey("Then callers should not share them", func() {
+			u1 := WithPrincipal(r, Principal{Id: "u1"})
+			u2 := WithPrincipal(r, Principal{Id: "u2", Roles: []string{"admin"}})
+			So(cacheKey(r), ShouldEqual, "/orders")
+			So(cacheKey(u1), ShouldNotEqual, cacheKey(u2))
+			So(cacheKey(u1), ShouldNotEqual, cacheKey(r))
+		})
+	})
+}
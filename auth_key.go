@@ -0,0 +1,361 @@
+package aqua
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ApiKey describes a key handed out to a client. Only the sha256 of the key
+// itself is kept, so a key that is lost cannot be recovered, only replaced.
+type ApiKey struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash,omitempty"`
+	Scopes  []string  `json:"scopes"`
+	Quota   int       `json:"quota,omitempty"`
+	Expires time.Time `json:"expires"`
+	Created time.Time `json:"created"`
+	Revoked bool      `json:"revoked,omitempty"`
+}
+
+// Expired checks if the key can no longer be used at the given time
+func (k ApiKey) Expired(at time.Time) bool {
+	return !k.Expires.IsZero() && at.After(k.Expires)
+}
+
+func (k ApiKey) claims() map[string]interface{} {
+	return map[string]interface{}{"sub": k.Id, "name": k.Name, "scope": k.Scopes}
+}
+
+// KeyStore keeps the api keys of KeyAuth. Find returns errKeyUnknown for a
+// hash it does not know.
+type KeyStore interface {
+	Find(hash string) (ApiKey, error)
+	Add(k ApiKey) error
+	Revoke(id string) error
+	List() ([]ApiKey, error)
+}
+
+var errKeyUnknown = errors.New("api key unknown")
+
+// hashKey returns the hash under which a key is stored
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewApiKey creates a key with the given name and scopes. The key itself is
+// returned along with it, and cannot be found out again later.
+func NewApiKey(name string, scopes ...string) (ApiKey, string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return ApiKey{}, "", err
+	}
+	key := base64.RawURLEncoding.EncodeToString(b)
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return ApiKey{}, "", err
+	}
+	if scopes == nil {
+		scopes = make([]string, 0)
+	}
+	return ApiKey{
+		Id:      hex.EncodeToString(id),
+		Name:    name,
+		Hash:    hashKey(key),
+		Scopes:  scopes,
+		Created: time.Now(),
+	}, key, nil
+}
+
+// KeyAuth is an Authorizer for api keys, sent in a header (X-Api-Key by
+// default) or, if Param is set, in the query string. The scopes of a key are
+// matched by the allow and deny tags (e.g. allow:"scope:orders.read"), and
+// a key with a quota is refused with a 429 once it has made that many
+// requests in the current Window (1h by default). Quotas are counted by each
+// server on its own.
+type KeyAuth struct {
+	Store  KeyStore
+	Header string
+	Param  string
+	Window time.Duration
+
+	mu   sync.Mutex
+	used map[string]*keyUse
+}
+
+type keyUse struct {
+	since time.Time
+	count int
+}
+
+var errKeyExpired = errors.New("api key expired")
+var errKeyRevoked = errors.New("api key revoked")
+
+func (a *KeyAuth) Authorize(r *http.Request, allow string, deny string) bool {
+	_, err := a.Identify(r, allow, deny)
+	return err == nil
+}
+
+// Identify authorizes the request and returns its key as the principal, with
+// the key id as id. A key over its quota is a 429.
+func (a *KeyAuth) Identify(r *http.Request, allow string, deny string) (Principal, error) {
+	k, err := a.key(r)
+	if err != nil {
+		if anonymousOk(allow, deny) {
+			return Principal{}, nil
+		}
+		return Principal{}, Unauthenticated(fmt.Sprintf("ApiKey header=%q", a.header()), err)
+	}
+	claims := k.claims()
+	p := Principal{Id: k.Id, Roles: make([]string, 0), Claims: claims, apiKey: true}
+	if matchExpr(claims, deny) || !(public(allow) || matchExpr(claims, allow)) {
+		return p, Forbidden(errAccessDenied)
+	}
+	if !a.spend(k) {
+		return p, Fault{
+			HTTPCode: http.StatusTooManyRequests,
+			Message:  "Quota exceeded",
+			Issue:    fmt.Errorf("api key %s is limited to %d requests per %s", k.Id, k.Quota, a.window()),
+		}
+	}
+	return p, nil
+}
+
+func (a *KeyAuth) header() string {
+	if a.Header == "" {
+		return "X-Api-Key"
+	}
+	return a.Header
+}
+
+func (a *KeyAuth) window() time.Duration {
+	if a.Window <= 0 {
+		return time.Hour
+	}
+	return a.Window
+}
+
+// key finds the key of the request in the store
+func (a *KeyAuth) key(r *http.Request) (ApiKey, error) {
+	s := r.Header.Get(a.header())
+	if s == "" && a.Param != "" {
+		s = r.URL.Query().Get(a.Param)
+	}
+	if s == "" {
+		return ApiKey{}, errors.New("api key missing")
+	}
+	k, err := a.Store.Find(hashKey(s))
+	switch {
+	case err != nil:
+		return ApiKey{}, err
+	case k.Revoked:
+		return ApiKey{}, errKeyRevoked
+	case k.Expired(time.Now()):
+		return ApiKey{}, errKeyExpired
+	}
+	return k, nil
+}
+
+// spend counts a request against the quota of the key
+func (a *KeyAuth) spend(k ApiKey) bool {
+	if k.Quota <= 0 {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.used == nil {
+		a.used = make(map[string]*keyUse)
+	}
+	u, found := a.used[k.Id]
+	if !found || time.Since(u.since) >= a.window() {
+		u = &keyUse{since: time.Now()}
+		a.used[k.Id] = u
+	}
+	if u.count >= k.Quota {
+		return false
+	}
+	u.count++
+	return true
+}
+
+type memKeys struct {
+	sync.RWMutex
+	byHash map[string]ApiKey
+}
+
+// MemoryKeys returns a key store that lives as long as the process
+func MemoryKeys() KeyStore {
+	return &memKeys{byHash: make(map[string]ApiKey)}
+}
+
+func (m *memKeys) Find(hash string) (ApiKey, error) {
+	m.RLock()
+	defer m.RUnlock()
+	k, found := m.byHash[hash]
+	if !found {
+		return ApiKey{}, errKeyUnknown
+	}
+	return k, nil
+}
+
+func (m *memKeys) Add(k ApiKey) error {
+	if k.Id == "" || k.Hash == "" {
+		return errors.New("api key needs an id and a hash")
+	}
+	m.Lock()
+	defer m.Unlock()
+	for _, o := range m.byHash {
+		if o.Id == k.Id {
+			return fmt.Errorf("api key %s exists", k.Id)
+		}
+	}
+	m.byHash[k.Hash] = k
+	return nil
+}
+
+func (m *memKeys) Revoke(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	for h, k := range m.byHash {
+		if k.Id == id {
+			k.Revoked = true
+			m.byHash[h] = k
+			return nil
+		}
+	}
+	return keyNotFound(id)
+}
+
+func (m *memKeys) List() ([]ApiKey, error) {
+	m.RLock()
+	defer m.RUnlock()
+	out := make([]ApiKey, 0, len(m.byHash))
+	for _, k := range m.byHash {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out, nil
+}
+
+// fileKeys keeps the keys in memory, and in a json file that is rewritten on
+// every change and read again when changed by someone else
+type fileKeys struct {
+	memKeys
+	path    string
+	modTime time.Time
+}
+
+// FileKeys returns a key store backed by a json file
+func FileKeys(path string) KeyStore {
+	f := &fileKeys{memKeys: memKeys{byHash: make(map[string]ApiKey)}, path: path}
+	if err := f.load(); err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// load reads the file, if it has changed since it was last read
+func (f *fileKeys) load() error {
+	st, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if st.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	keys := make([]ApiKey, 0)
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &keys); err != nil {
+			return fmt.Errorf("%s: %s", f.path, err)
+		}
+	}
+	f.byHash = make(map[string]ApiKey)
+	for _, k := range keys {
+		f.byHash[k.Hash] = k
+	}
+	f.modTime = st.ModTime()
+	return nil
+}
+
+// save writes all keys to the file; the caller holds the lock
+func (f *fileKeys) save() error {
+	keys := make([]ApiKey, 0, len(f.byHash))
+	for _, k := range f.byHash {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return err
+	}
+	if st, err := os.Stat(f.path); err == nil {
+		f.modTime = st.ModTime()
+	}
+	return nil
+}
+
+func (f *fileKeys) Find(hash string) (ApiKey, error) {
+	if err := f.load(); err != nil {
+		return ApiKey{}, err
+	}
+	return f.memKeys.Find(hash)
+}
+
+func (f *fileKeys) Add(k ApiKey) error {
+	if err := f.load(); err != nil {
+		return err
+	}
+	if err := f.memKeys.Add(k); err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	return f.save()
+}
+
+func (f *fileKeys) Revoke(id string) error {
+	if err := f.load(); err != nil {
+		return err
+	}
+	if err := f.memKeys.Revoke(id); err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	return f.save()
+}
+
+func (f *fileKeys) List() ([]ApiKey, error) {
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f.memKeys.List()
+}
@@ -0,0 +1,251 @@
+package aqua
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type orderService struct {
+	RestService
+	orders GET    `url:"/orders" allow:"scope:orders.read"`
+	cancel DELETE `url:"/orders/{id}" allow:"scope:orders.write"`
+}
+
+func (s *orderService) Orders() string {
+	return "orders"
+}
+
+func (s *orderService) Cancel(id string) string {
+	return "cancelled " + id
+}
+
+type stockService struct {
+	RestService `root:"key-stock"`
+	items       CRUD
+	file        string
+	admin       string
+}
+
+func (s *stockService) Items() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "memory", Conn: "key-stock"},
+		Model: func() (interface{}, interface{}) {
+			return &ledger{}, &[]ledger{}
+		},
+		Audit: AuditFile(s.file),
+		Admin: s.admin,
+	}
+}
+
+func keyRequest(header string, key string) *http.Request {
+	r, _ := http.NewRequest("GET", "/orders", nil)
+	if key != "" {
+		r.Header.Set(header, key)
+	}
+	return r
+}
+
+func TestKeyAuth(t *testing.T) {
+
+	Convey("Given a key authorizer", t, func() {
+		store := MemoryKeys()
+		a := &KeyAuth{Store: store, Param: "api_key"}
+
+		reader, readKey, _ := NewApiKey("reader", "orders.read")
+		store.Add(reader)
+
+		Convey("Then keys should be stored hashed", func() {
+			keys, _ := store.List()
+			So(keys[0].Hash, ShouldEqual, hashKey(readKey))
+			So(keys[0].Hash, ShouldNotContainSubstring, readKey)
+		})
+		Convey("Then the scopes of a key should be matched by allow and deny", func() {
+			p, err := a.Identify(keyRequest("X-Api-Key", readKey), "scope:orders.read", "")
+			So(err, ShouldBeNil)
+			So(p.Id, ShouldEqual, reader.Id)
+			So(p.Claims["name"], ShouldEqual, "reader")
+
+			_, err = a.Identify(keyRequest("X-Api-Key", readKey), "scope:orders.write", "")
+			So(err.(Fault).HTTPCode, ShouldEqual, 403)
+			_, err = a.Identify(keyRequest("X-Api-Key", readKey), "", "name:reader")
+			So(err.(Fault).HTTPCode, ShouldEqual, 403)
+		})
+		Convey("Then the key should be read from the query string if enabled", func() {
+			r, _ := http.NewRequest("GET", "/orders?api_key="+url.QueryEscape(readKey), nil)
+			So(a.Authorize(r, "scope:orders.read", ""), ShouldBeTrue)
+			a.Param = ""
+			So(a.Authorize(r, "scope:orders.read", ""), ShouldBeFalse)
+		})
+		Convey("Then unknown, revoked and expired keys should be refused with a 401", func() {
+			old, oldKey, _ := NewApiKey("old", "orders.read")
+			old.Expires = time.Now().Add(-time.Minute)
+			store.Add(old)
+
+			_, err := a.Identify(keyRequest("X-Api-Key", "nope"), "scope:orders.read", "")
+			So(err.(Fault).HTTPCode, ShouldEqual, 401)
+			So(err.(Fault).challenge, ShouldEqual, `ApiKey header="X-Api-Key"`)
+			_, err = a.Identify(keyRequest("X-Api-Key", oldKey), "scope:orders.read", "")
+			So(err.(Fault).Issue, ShouldEqual, errKeyExpired)
+
+			So(store.Revoke(reader.Id), ShouldBeNil)
+			_, err = a.Identify(keyRequest("X-Api-Key", readKey), "scope:orders.read", "")
+			So(err.(Fault).Issue, ShouldEqual, errKeyRevoked)
+		})
+		Convey("Then public endpoints should not need a key", func() {
+			So(a.Authorize(keyRequest("X-Api-Key", ""), "", ""), ShouldBeTrue)
+			So(a.Authorize(keyRequest("X-Api-Key", ""), "authenticated", ""), ShouldBeFalse)
+		})
+		Convey("Then a key should be held to its quota", func() {
+			busy, busyKey, _ := NewApiKey("busy", "orders.read")
+			busy.Quota = 2
+			store.Add(busy)
+			a.Window = 50 * time.Millisecond
+
+			for i := 0; i < 2; i++ {
+				_, err := a.Identify(keyRequest("X-Api-Key", busyKey), "scope:orders.read", "")
+				So(err, ShouldBeNil)
+			}
+			_, err := a.Identify(keyRequest("X-Api-Key", busyKey), "scope:orders.read", "")
+			So(err.(Fault).HTTPCode, ShouldEqual, 429)
+
+			time.Sleep(60 * time.Millisecond)
+			_, err = a.Identify(keyRequest("X-Api-Key", busyKey), "scope:orders.read", "")
+			So(err, ShouldBeNil)
+		})
+	})
+
+	Convey("Given a file key store", t, func() {
+		f, _ := ioutil.TempFile("", "keys")
+		f.Close()
+		os.Remove(f.Name())
+		defer os.Remove(f.Name())
+
+		store := FileKeys(f.Name())
+		k, key, _ := NewApiKey("billing", "invoices.read")
+		So(store.Add(k), ShouldBeNil)
+
+		Convey("Then keys should survive a restart", func() {
+			again := FileKeys(f.Name())
+			found, err := again.Find(hashKey(key))
+			So(err, ShouldBeNil)
+			So(found.Name, ShouldEqual, "billing")
+
+			So(again.Revoke(k.Id), ShouldBeNil)
+			found, _ = FileKeys(f.Name()).Find(hashKey(key))
+			So(found.Revoked, ShouldBeTrue)
+		})
+		Convey("Then the keys themselves should not be written", func() {
+			b, _ := ioutil.ReadFile(f.Name())
+			So(string(b), ShouldNotContainSubstring, key)
+			So(string(b), ShouldContainSubstring, k.Hash)
+		})
+	})
+
+	store := MemoryKeys()
+	admin, adminKey, _ := NewApiKey("ops", "keys.admin")
+	store.Add(admin)
+
+	audit, _ := ioutil.TempFile("", "key-audit")
+	audit.Close()
+	defer os.Remove(audit.Name())
+
+	s := NewRestServer()
+	s.SetAuth(&KeyAuth{Store: store})
+	s.AddService(NewKeyService(store, "scope:keys.admin"))
+	s.AddService(&orderService{})
+	s.AddService(&stockService{file: audit.Name(), admin: "scope:audit.read"})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	call := func(method, path, key, body string) (int, string) {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", s.Port, path), strings.NewReader(body))
+		req.Header.Set("X-Api-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	Convey("Given the key admin endpoints", t, func() {
+
+		Convey("Then keys should be created, used, listed and revoked", func() {
+			code, body := call("POST", "/aqua/keys", adminKey, `{"name":"shop","scopes":["orders.read"],"ttl":"24h"}`)
+			So(code, ShouldEqual, 200)
+			var out struct {
+				Key    string `json:"key"`
+				ApiKey ApiKey `json:"api_key"`
+			}
+			json.Unmarshal([]byte(body), &out)
+			So(out.Key, ShouldNotBeEmpty)
+			So(out.ApiKey.Hash, ShouldBeEmpty)
+
+			code, body = call("GET", "/order/orders", out.Key, "")
+			So(code, ShouldEqual, 200)
+			So(body, ShouldEqual, "orders")
+			code, _ = call("DELETE", "/order/orders/9", out.Key, "")
+			So(code, ShouldEqual, 403)
+
+			code, body = call("GET", "/aqua/keys", adminKey, "")
+			So(code, ShouldEqual, 200)
+			So(body, ShouldContainSubstring, `"name":"shop"`)
+			So(body, ShouldNotContainSubstring, admin.Hash)
+
+			code, _ = call("DELETE", "/aqua/keys/"+out.ApiKey.Id, adminKey, "")
+			So(code, ShouldEqual, 200)
+			code, _ = call("GET", "/order/orders", out.Key, "")
+			So(code, ShouldEqual, 401)
+		})
+		Convey("Then they should be open to admins only", func() {
+			_, shopKey, _ := NewApiKey("shop", "orders.read")
+			code, _ := call("GET", "/aqua/keys", shopKey, "")
+			So(code, ShouldEqual, 401)
+			code, _ = call("GET", "/aqua/keys", "", "")
+			So(code, ShouldEqual, 401)
+		})
+		Convey("Then a key without a name should be refused", func() {
+			code, _ := call("POST", "/aqua/keys", adminKey, `{"scopes":["x"]}`)
+			So(code, ShouldEqual, 400)
+		})
+		Convey("Then revoking an unknown key should be a 404", func() {
+			code, body := call("DELETE", "/aqua/keys/nope", adminKey, "")
+			So(code, ShouldEqual, 404)
+			So(body, ShouldContainSubstring, `"message":"Not found"`)
+		})
+	})
+
+	Convey("Given a key with a quota that is allowed admin access to a CRUD", t, func() {
+		auditor, auditKey, _ := NewApiKey("auditor", "audit.read")
+		auditor.Quota = 2
+		store.Add(auditor)
+
+		Convey("Then each admin request should use up one unit of quota", func() {
+			for i := 0; i < 2; i++ {
+				code, _ := call("GET", "/aqua/audit?resource=key-stock/items", auditKey, "")
+				So(code, ShouldEqual, 200)
+			}
+			code, _ := call("GET", "/aqua/audit?resource=key-stock/items", auditKey, "")
+			So(code, ShouldEqual, 429)
+		})
+	})
+
+	Convey("Given the key admin endpoints on a server without an Authorizer", t, func() {
+		s := NewRestServer()
+		s.AddService(NewKeyService(MemoryKeys(), "scope:keys.admin"))
+		Convey("Then the server should refuse to start", func() {
+			So(s.loadAllEndpoints, ShouldPanic)
+		})
+	})
+}
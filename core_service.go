@@ -1,8 +1,11 @@
 package aqua
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/pivotal-golang/bytefmt"
@@ -11,8 +14,12 @@ import (
 type CoreService struct {
 	RestService `root:"/aqua/"`
 	ping        GET `url:"/ping"`
-	status      GET `url:"/status" pretty:"true"`
+	status      GET `url:"/status" pretty:"true" allow_ip:"private"`
 	date        GET `url:"/time"`
+	audit       GET `url:"/audit"`
+
+	// audited cruds of the server, by resource
+	audits map[string]*CRUD
 }
 
 func (me *CoreService) Ping() string {
@@ -53,3 +60,41 @@ func (me *CoreService) Status() map[string]interface{} {
 func (me *CoreService) Date(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(time.Now().Format("2006-01-02 15:04:05 MST")))
 }
+
+// Audit serves the audit entries of a crud resource:
+// /aqua/audit?resource=catalog/products&key=12&limit=20&offset=0
+func (me *CoreService) Audit(j Aide) interface{} {
+	q := j.Request.URL.Query()
+	res := strings.Trim(q.Get("resource"), "/")
+	if res == "" {
+		return badParam("Resource not specified")
+	}
+	c, found := me.audits[res]
+	if !found {
+		return Fault{
+			HTTPCode: 404,
+			Message:  "No audit trail for " + res,
+			Issue:    errors.New("resource not found or not audited: " + res),
+		}
+	}
+	if !c.isAdmin(j.Request) {
+		return adminOnly("audit")
+	}
+	rd, ok := c.Audit.(AuditReader)
+	if !ok {
+		return Fault{
+			HTTPCode: http.StatusNotImplemented,
+			Message:  "Audit entries cannot be queried",
+			Issue:    fmt.Errorf("audit sink %T cannot be read", c.Audit),
+		}
+	}
+	lim, off, err := page(q)
+	if err != nil {
+		return err
+	}
+	out, err := rd.Entries(AuditQuery{Resource: res, Key: q.Get("key"), Limit: lim, Offset: off})
+	if err != nil {
+		return err
+	}
+	return out
+}
@@ -0,0 +1,178 @@
+package aqua
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// corsConfig is the CORS setup of an endpoint, read from the cors tags:
+//
+//	cors              origins allowed, separated by commas: *, https://app.com
+//	                  or patterns like https://*.app.com ("-" turns cors off)
+//	cors_methods      methods allowed (default: those setup for the url)
+//	cors_headers      request headers allowed (default: Content-Type and
+//	                  Authorization; * allows whatever is asked for)
+//	cors_credentials  true to allow cookies and credentials
+//	cors_max_age      seconds a preflight can be cached for
+type corsConfig struct {
+	origins     []string
+	methods     string
+	headers     string
+	credentials bool
+	maxAge      string
+}
+
+const corsDefaultHeaders = "Content-Type, Authorization"
+
+// newCors reads the cors setup of a fixture, and returns nil if cors is off
+func newCors(f Fixture) (*corsConfig, error) {
+	if f.Cors == "" || f.Cors == "-" {
+		return nil, nil
+	}
+	c := &corsConfig{
+		origins: splitExpr(f.Cors),
+		methods: strings.ToUpper(f.CorsMethods),
+		headers: f.CorsHeaders,
+	}
+	if c.headers == "" {
+		c.headers = corsDefaultHeaders
+	}
+	switch f.CorsCredentials {
+	case "", "false":
+	case "true":
+		c.credentials = true
+	default:
+		return nil, fmt.Errorf("invalid cors_credentials %q, expected true or false", f.CorsCredentials)
+	}
+	if c.credentials {
+		// any site could then read responses with the cookies of its visitors
+		for _, o := range c.origins {
+			if o == "*" {
+				return nil, fmt.Errorf("cors_credentials cannot be used with cors \"*\", list the origins")
+			}
+		}
+	}
+	if f.CorsMaxAge != "" {
+		if n, err := strconv.Atoi(f.CorsMaxAge); err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid cors_max_age %q, expected seconds", f.CorsMaxAge)
+		}
+		c.maxAge = f.CorsMaxAge
+	}
+	return c, nil
+}
+
+// allows checks if requests from the origin are allowed
+func (c *corsConfig) allows(origin string) bool {
+	for _, o := range c.origins {
+		if matchOrigin(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin matches an origin against *, an origin, or a pattern with a *
+// standing in for one or more subdomains
+func matchOrigin(pattern string, origin string) bool {
+	if pattern == "*" || strings.EqualFold(pattern, origin) {
+		return true
+	}
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return false
+	}
+	pre, suf := strings.ToLower(pattern[:i]), strings.ToLower(pattern[i+1:])
+	o := strings.ToLower(origin)
+	if len(o) <= len(pre)+len(suf) || !strings.HasPrefix(o, pre) || !strings.HasSuffix(o, suf) {
+		return false
+	}
+	mid := o[len(pre) : len(o)-len(suf)]
+	return !strings.ContainsAny(mid, "/:")
+}
+
+// allowOrigin sets the headers that let the origin read the response
+func (c *corsConfig) allowOrigin(h http.Header, origin string) {
+	h.Add("Vary", "Origin")
+	if len(c.origins) == 1 && c.origins[0] == "*" {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// wrap adds the cors headers to the responses of an endpoint, including the
+// ones of modules (e.g. a 429), so that the browser lets the client read them
+func (c *corsConfig) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && c.allows(origin) {
+			c.allowOrigin(w.Header(), origin)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflight answers the OPTIONS requests of a url, with the cors setup of
+// the endpoint of the method the browser asks for
+type preflight struct {
+	sync.RWMutex
+	cors map[string]*corsConfig // by method, nil if cors is off
+}
+
+func (p *preflight) add(method string, c *corsConfig) {
+	p.Lock()
+	defer p.Unlock()
+	p.cors[method] = c
+}
+
+func (p *preflight) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.RLock()
+	defer p.RUnlock()
+
+	all := make([]string, 0, len(p.cors))
+	for m := range p.cors {
+		all = append(all, m)
+	}
+	sort.Strings(all)
+	h := w.Header()
+	h.Set("Allow", strings.Join(append(all, "OPTIONS"), ", "))
+
+	origin := r.Header.Get("Origin")
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	c := p.cors[method]
+	if origin == "" || c == nil || !c.allows(origin) {
+		h.Add("Vary", "Origin")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	c.allowOrigin(h, origin)
+	methods := c.methods
+	if methods == "" {
+		open := make([]string, 0)
+		for _, m := range all {
+			if o := p.cors[m]; o != nil && o.allows(origin) {
+				open = append(open, m)
+			}
+		}
+		methods = strings.Join(open, ", ")
+	}
+	h.Set("Access-Control-Allow-Methods", methods)
+	if c.headers == "*" {
+		if asked := r.Header.Get("Access-Control-Request-Headers"); asked != "" {
+			h.Set("Access-Control-Allow-Headers", asked)
+		}
+	} else {
+		h.Set("Access-Control-Allow-Headers", c.headers)
+	}
+	if c.maxAge != "" {
+		h.Set("Access-Control-Max-Age", c.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,120 @@
+package aqua
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type corsService struct {
+	RestService `cors:"https://app.example.com,https://*.example.org" cors_max_age:"600"`
+	list        GET    `url:"/items"`
+	add         POST   `url:"/items" cors_credentials:"true" cors_headers:"*"`
+	drop        DELETE `url:"/items/{id}" cors:"-"`
+	limited     GET    `url:"/limited" rate:"1/h" rate_by:"ip"`
+}
+
+func (s *corsService) List() string {
+	return "items"
+}
+
+func (s *corsService) Add() string {
+	return "added"
+}
+
+func (s *corsService) Drop(id string) string {
+	return "dropped"
+}
+
+func (s *corsService) Limited() string {
+	return "ok"
+}
+
+func TestCors(t *testing.T) {
+
+	Convey("Given origin patterns", t, func() {
+		Convey("Then they should match origins", func() {
+			So(matchOrigin("*", "https://a.com"), ShouldBeTrue)
+			So(matchOrigin("https://a.com", "https://A.com"), ShouldBeTrue)
+			So(matchOrigin("https://*.a.com", "https://x.y.a.com"), ShouldBeTrue)
+			So(matchOrigin("https://*.a.com", "https://a.com"), ShouldBeFalse)
+			So(matchOrigin("https://*.a.com", "https://evil.com/.a.com"), ShouldBeFalse)
+			So(matchOrigin("https://*.a.com", "http://x.a.com"), ShouldBeFalse)
+		})
+		Convey("Then invalid settings should be refused at startup", func() {
+			_, err := newCors(Fixture{Cors: "*", CorsMaxAge: "long"})
+			So(err, ShouldNotBeNil)
+			_, err = newCors(Fixture{Cors: "*", CorsCredentials: "yes"})
+			So(err, ShouldNotBeNil)
+			_, err = newCors(Fixture{Cors: "https://app.com,*", CorsCredentials: "true"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	s := NewRestServer()
+	s.AddService(&corsService{})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	send := func(method string, path string, hdr map[string]string) *http.Response {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://localhost:%d/cors%s", s.Port, path), nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	preflight := func(path string, origin string, method string) *http.Response {
+		return send("OPTIONS", path, map[string]string{"Origin": origin,
+			"Access-Control-Request-Method": method, "Access-Control-Request-Headers": "X-Trace"})
+	}
+
+	Convey("Given a service with cors", t, func() {
+
+		Convey("Then preflights should be answered for allowed origins", func() {
+			resp := preflight("/items", "https://app.example.com", "GET")
+			So(resp.StatusCode, ShouldEqual, 204)
+			So(resp.Header.Get("Access-Control-Allow-Origin"), ShouldEqual, "https://app.example.com")
+			So(resp.Header.Get("Access-Control-Allow-Methods"), ShouldEqual, "GET, POST")
+			So(resp.Header.Get("Access-Control-Allow-Headers"), ShouldEqual, "Content-Type, Authorization")
+			So(resp.Header.Get("Access-Control-Max-Age"), ShouldEqual, "600")
+			So(resp.Header.Get("Access-Control-Allow-Credentials"), ShouldBeEmpty)
+		})
+		Convey("Then the setup of the method asked for should be used", func() {
+			resp := preflight("/items", "https://shop.example.org", "POST")
+			So(resp.Header.Get("Access-Control-Allow-Origin"), ShouldEqual, "https://shop.example.org")
+			So(resp.Header.Get("Access-Control-Allow-Credentials"), ShouldEqual, "true")
+			So(resp.Header.Get("Access-Control-Allow-Headers"), ShouldEqual, "X-Trace")
+		})
+		Convey("Then other origins and endpoints without cors should get no cors headers", func() {
+			resp := preflight("/items", "https://evil.com", "GET")
+			So(resp.StatusCode, ShouldEqual, 204)
+			So(resp.Header.Get("Access-Control-Allow-Origin"), ShouldBeEmpty)
+
+			resp = preflight("/items/7", "https://app.example.com", "DELETE")
+			So(resp.Header.Get("Access-Control-Allow-Origin"), ShouldBeEmpty)
+			So(resp.Header.Get("Allow"), ShouldEqual, "DELETE, OPTIONS")
+		})
+		Convey("Then responses should carry the cors headers", func() {
+			resp := send("GET", "/items", map[string]string{"Origin": "https://app.example.com"})
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(resp.Header.Get("Access-Control-Allow-Origin"), ShouldEqual, "https://app.example.com")
+			So(resp.Header.Get("Vary"), ShouldEqual, "Origin")
+
+			resp = send("GET", "/items", map[string]string{"Origin": "https://evil.com"})
+			So(resp.Header.Get("Access-Control-Allow-Origin"), ShouldBeEmpty)
+		})
+		Convey("Then faults should carry them too", func() {
+			send("GET", "/limited", nil)
+			resp := send("GET", "/limited", map[string]string{"Origin": "https://app.example.com"})
+			So(resp.StatusCode, ShouldEqual, 429)
+			So(resp.Header.Get("Access-Control-Allow-Origin"), ShouldEqual, "https://app.example.com")
+		})
+	})
+}
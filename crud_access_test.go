@@ -0,0 +1,117 @@
+package aqua
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type catalogService struct {
+	RestService
+	items    CRUD `allow_write:"admin" allow_delete:"root"`
+	readOnly CRUD `ops:"read,list"`
+}
+
+func (s *catalogService) crud() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "mysql", Conn: "blah"},
+		Model: func() (interface{}, interface{}) {
+			return &sale{}, &[]sale{}
+		},
+	}
+}
+
+func (s *catalogService) Items() CRUD    { return s.crud() }
+func (s *catalogService) ReadOnly() CRUD { return s.crud() }
+
+type editorService struct {
+	RestService `allow_write:"admin" deny_delete:"guest"`
+	items       CRUD `allow:"editor" deny:"intern"`
+	rest        CRUD
+}
+
+func (s *editorService) Items() CRUD { return (&catalogService{}).crud() }
+func (s *editorService) Rest() CRUD  { return (&catalogService{}).crud() }
+
+type badOpsService struct {
+	RestService
+	items CRUD `ops:"read,purge"`
+}
+
+func (s *badOpsService) Items() CRUD {
+	return (&catalogService{}).crud()
+}
+
+func TestCrudAccessPerVerb(t *testing.T) {
+
+	s := NewRestServer()
+	s.SetAuth(roleAuth{})
+	s.AddService(&catalogService{})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	Convey("Given a CRUD with acl per verb", t, func() {
+		Convey("Then each route should get the acl of its verb", func() {
+			So(s.apis["GET:/catalog/items/{pkey}"].config.Allow, ShouldEqual, "")
+			So(s.apis["POST:/catalog/items/$"].config.Allow, ShouldEqual, "")
+			So(s.apis["POST:/catalog/items"].config.Allow, ShouldEqual, "admin")
+			So(s.apis["PUT:/catalog/items/{pkey}"].config.Allow, ShouldEqual, "admin")
+			So(s.apis["DELETE:/catalog/items/{pkey}"].config.Allow, ShouldEqual, "root")
+		})
+		Convey("Then writes should be authorized with the acl of writes", func() {
+			req, _ := http.NewRequest("PUT", fmt.Sprintf("http://localhost:%d/catalog/items/1", s.Port), nil)
+			req.Header.Set("X-Role", "guest")
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, 401)
+			So(resp.Header.Get("WWW-Authenticate"), ShouldNotBeEmpty)
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(string(b), ShouldContainSubstring, `"message":"Unauthorized Access"`)
+		})
+	})
+
+	Convey("Given a CRUD with an acl, in a service with acl per verb", t, func() {
+		s := NewRestServer()
+		s.AddService(&editorService{})
+		s.loadAllEndpoints()
+
+		Convey("Then the acl of the field should beat the ones of the service", func() {
+			So(s.apis["PUT:/editor/items/{pkey}"].config.Allow, ShouldEqual, "editor")
+			So(s.apis["DELETE:/editor/items/{pkey}"].config.Deny, ShouldEqual, "intern")
+		})
+		Convey("Then fields without an acl should get the ones of the service", func() {
+			So(s.apis["PUT:/editor/rest/{pkey}"].config.Allow, ShouldEqual, "admin")
+			So(s.apis["DELETE:/editor/rest/{pkey}"].config.Deny, ShouldEqual, "guest")
+			So(s.apis["GET:/editor/rest/{pkey}"].config.Allow, ShouldEqual, "")
+		})
+	})
+
+	Convey("Given a CRUD with ops", t, func() {
+		Convey("Then only the routes of the listed ops should be setup", func() {
+			_, found := s.apis["GET:/catalog/read-only/{pkey}"]
+			So(found, ShouldBeTrue)
+			_, found = s.apis["GET:/catalog/read-only"]
+			So(found, ShouldBeTrue)
+			for _, id := range []string{
+				"POST:/catalog/read-only",
+				"PUT:/catalog/read-only/{pkey}",
+				"DELETE:/catalog/read-only/{pkey}",
+				"POST:/catalog/read-only/$",
+				"GET:/catalog/read-only/aggregate",
+			} {
+				_, found = s.apis[id]
+				So(found, ShouldBeFalse)
+			}
+		})
+		Convey("Then unknown ops should panic", func() {
+			s := NewRestServer()
+			s.AddService(&badOpsService{})
+			So(s.loadAllEndpoints, ShouldPanic)
+		})
+	})
+}
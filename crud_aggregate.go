@@ -0,0 +1,124 @@
+package aqua
+
+import (
+	"database/sql"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Aggregates are requested as ?agg=count,sum(amount),max(amount)&by=status
+// and are returned as one row per group, with keys such as count, sum_amount
+// and max_amount next to the group columns.
+
+var aggFuncs = map[string]string{
+	"count": "COUNT",
+	"sum":   "SUM",
+	"avg":   "AVG",
+	"min":   "MIN",
+	"max":   "MAX",
+}
+
+type aggregate struct {
+	fn     string
+	column string
+	alias  string
+}
+
+func (a aggregate) sql() string {
+	col := a.column
+	if col == "" {
+		col = "*"
+	}
+	return aggFuncs[a.fn] + "(" + col + ") AS " + a.alias
+}
+
+// aggregates parses the ?agg parameter, which defaults to a count
+func (c *CRUD) aggregates(m interface{}, q url.Values) ([]aggregate, error) {
+	spec := q.Get("agg")
+	if spec == "" {
+		spec = "count"
+	}
+	out := make([]aggregate, 0)
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		fn, name := s, ""
+		if open := strings.Index(s, "("); open > 0 && strings.HasSuffix(s, ")") {
+			fn, name = s[:open], s[open+1:len(s)-1]
+		}
+		if _, ok := aggFuncs[fn]; !ok {
+			return nil, badParam("Unknown aggregate " + fn)
+		}
+		a := aggregate{fn: fn, alias: fn}
+		if name != "" {
+			col, ok := c.whitelisted(m, name)
+			if !ok {
+				return nil, badParam("Cannot aggregate on " + name)
+			}
+			a.column = col
+			a.alias = fn + "_" + col
+		} else if fn != "count" {
+			return nil, badParam(fn + " needs a column, as in " + fn + "(column)")
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// groups parses the ?by parameter
+func (c *CRUD) groups(m interface{}, q url.Values) ([]string, error) {
+	out := make([]string, 0)
+	if q.Get("by") == "" {
+		return out, nil
+	}
+	for _, g := range strings.Split(q.Get("by"), ",") {
+		col, ok := c.whitelisted(m, strings.TrimSpace(g))
+		if !ok {
+			return nil, badParam("Cannot group by " + g)
+		}
+		out = append(out, col)
+	}
+	return out, nil
+}
+
+// scanRows reads aggregate results into maps. Drivers return most values as
+// bytes, so aggregates are turned into numbers and groups into strings.
+func scanRows(rows *sql.Rows, aggs []aggregate) ([]map[string]interface{}, error) {
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	isAgg := make(map[string]bool)
+	for _, a := range aggs {
+		isAgg[a.alias] = true
+	}
+
+	out := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{})
+		for i, col := range cols {
+			v := vals[i]
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+				if isAgg[col] {
+					if f, err := strconv.ParseFloat(string(b), 64); err == nil {
+						v = f
+					}
+				}
+			}
+			row[col] = v
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,319 @@
+package aqua
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/db/cstr"
+	"github.com/mayur-tolexo/aero/db/orm"
+)
+
+// With an Audit sink, each create, update, delete and restore made through a
+// CRUD is recorded once it is committed, along with the caller, the request
+// id (the X-Request-Id header, or one generated by aqua) and the values of
+// the fields before and after the write. Updates record the changed fields
+// only. Hidden and write only fields are never recorded.
+//
+// Entries of sinks that can be read back are served by GET /aqua/audit to
+// callers whose principal matches the claim expression of CRUD.Admin.
+
+// AuditEntry is the record of one write
+type AuditEntry struct {
+	At        time.Time              `json:"at"`
+	Resource  string                 `json:"resource"`
+	Key       string                 `json:"key"`
+	Action    string                 `json:"action"`
+	Who       string                 `json:"who"`
+	RequestId string                 `json:"request_id"`
+	Before    map[string]interface{} `json:"before,omitempty"`
+	After     map[string]interface{} `json:"after,omitempty"`
+}
+
+// AuditSink receives the audit entries of a CRUD
+type AuditSink interface {
+	Record(e AuditEntry) error
+}
+
+// AuditReader is implemented by sinks whose entries can be queried
+type AuditReader interface {
+	Entries(q AuditQuery) ([]AuditEntry, error)
+}
+
+// AuditQuery selects the entries of a resource (and optionally a key),
+// newest first
+type AuditQuery struct {
+	Resource string
+	Key      string
+	Limit    int
+	Offset   int
+}
+
+func (q AuditQuery) match(e AuditEntry) bool {
+	return e.Resource == q.Resource && (q.Key == "" || e.Key == q.Key)
+}
+
+// AuditFunc is a sink that hands entries to a callback
+type AuditFunc func(e AuditEntry) error
+
+func (f AuditFunc) Record(e AuditEntry) error {
+	return f(e)
+}
+
+// auditRow is how entries are stored by the table sink
+type auditRow struct {
+	Id        int64     `gorm:"primary_key"`
+	At        time.Time `gorm:"index"`
+	Resource  string    `gorm:"index"`
+	Pkey      string
+	Action    string
+	Who       string
+	RequestId string
+	Before    string `gorm:"type:text"`
+	After     string `gorm:"type:text"`
+}
+
+func (auditRow) TableName() string {
+	return "aqua_audit"
+}
+
+type auditTable struct {
+	storage cstr.Storage
+	once    sync.Once
+	err     error
+}
+
+// AuditTable returns a sink that stores entries in the aqua_audit table of
+// the given storage (the master database if empty). The table is created
+// on first use.
+func AuditTable(s cstr.Storage) AuditSink {
+	if s.Engine == "" && s.Conn == "" {
+		s = cstr.Get(true)
+	}
+	return &auditTable{storage: s}
+}
+
+func (a *auditTable) conn() (*gorm.DB, error) {
+	dbo := orm.GetConn(a.storage.Engine, a.storage.Conn)
+	a.once.Do(func() {
+		a.err = dbo.AutoMigrate(&auditRow{}).Error
+	})
+	return dbo, a.err
+}
+
+func (a *auditTable) Record(e AuditEntry) error {
+	dbo, err := a.conn()
+	if err != nil {
+		return err
+	}
+	row := auditRow{
+		At:        e.At,
+		Resource:  e.Resource,
+		Pkey:      e.Key,
+		Action:    e.Action,
+		Who:       e.Who,
+		RequestId: e.RequestId,
+	}
+	if e.Before != nil {
+		b, _ := json.Marshal(e.Before)
+		row.Before = string(b)
+	}
+	if e.After != nil {
+		b, _ := json.Marshal(e.After)
+		row.After = string(b)
+	}
+	return dbo.Create(&row).Error
+}
+
+func (a *auditTable) Entries(q AuditQuery) ([]AuditEntry, error) {
+	dbo, err := a.conn()
+	if err != nil {
+		return nil, err
+	}
+	qry := dbo.Where("resource = ?", q.Resource)
+	if q.Key != "" {
+		qry = qry.Where("pkey = ?", q.Key)
+	}
+	rows := make([]auditRow, 0)
+	if err := qry.Order("id desc").Limit(q.Limit).Offset(q.Offset).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]AuditEntry, len(rows))
+	for i, r := range rows {
+		out[i] = AuditEntry{
+			At:        r.At,
+			Resource:  r.Resource,
+			Key:       r.Pkey,
+			Action:    r.Action,
+			Who:       r.Who,
+			RequestId: r.RequestId,
+		}
+		if r.Before != "" {
+			json.Unmarshal([]byte(r.Before), &out[i].Before)
+		}
+		if r.After != "" {
+			json.Unmarshal([]byte(r.After), &out[i].After)
+		}
+	}
+	return out, nil
+}
+
+type auditFile struct {
+	sync.Mutex
+	path string
+	f    *os.File
+}
+
+// audit files are shared by the cruds that write to the same path
+var auditFiles = struct {
+	sync.Mutex
+	byPath map[string]*auditFile
+}{byPath: make(map[string]*auditFile)}
+
+// AuditFile returns a sink that appends entries to a file, one json object
+// per line
+func AuditFile(path string) AuditSink {
+	auditFiles.Lock()
+	defer auditFiles.Unlock()
+	if a, found := auditFiles.byPath[path]; found {
+		return a
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		panic(err)
+	}
+	a := &auditFile{path: path, f: f}
+	auditFiles.byPath[path] = a
+	return a
+}
+
+func (a *auditFile) Record(e AuditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	_, err = a.f.Write(append(b, '\n'))
+	return err
+}
+
+func (a *auditFile) Entries(q AuditQuery) ([]AuditEntry, error) {
+	a.Lock()
+	defer a.Unlock()
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	all := make([]AuditEntry, 0)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), importMaxLine)
+	for sc.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil && q.match(e) {
+			all = append(all, e)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]AuditEntry, 0)
+	for i := len(all) - 1 - q.Offset; i >= 0 && len(out) < q.Limit; i-- {
+		out = append(out, all[i])
+	}
+	return out, nil
+}
+
+func (c *CRUD) validateAudit() {
+	if c.Audit == nil {
+		return
+	}
+	if meth := c.getMethod("create"); meth != "Rdbms_Create" && meth != "Memory_Create" {
+		panic("Crud audit is supported for RDBMS and memory engines only")
+	}
+}
+
+// requestId returns the id of the request, assigning one if the client did
+// not send any
+func requestId(j Aide) string {
+	if j.Request == nil {
+		return ""
+	}
+	id := j.Request.Header.Get("X-Request-Id")
+	if id == "" {
+		id = newUUID()
+		j.Request.Header.Set("X-Request-Id", id)
+		if j.Response != nil {
+			j.Response.Header().Set("X-Request-Id", id)
+		}
+	}
+	return id
+}
+
+// audit hands an entry to the sink once the write is committed. Writes to the
+// memory engine are not transactional, so they are recorded right away.
+func (c *CRUD) audit(j Aide, action string, key string, before, after map[string]interface{}) {
+	if c.Audit == nil {
+		return
+	}
+	e := AuditEntry{
+		At:        time.Now().UTC(),
+		Resource:  c.resource,
+		Key:       key,
+		Action:    action,
+		Who:       principalOf(j.Request).Id,
+		RequestId: requestId(j),
+		Before:    before,
+		After:     after,
+	}
+	record := func() {
+		if err := c.Audit.Record(e); err != nil {
+			if c.auditFailed != nil {
+				c.auditFailed(e, err)
+			} else {
+				log.Printf("aqua: audit of %s %s %s failed: %s", e.Action, e.Resource, e.Key, err)
+			}
+		}
+	}
+	if j.txs == nil || c.getMethod("create") != "Rdbms_Create" {
+		record()
+	} else {
+		j.txs.afterCommit(record)
+	}
+}
+
+// auditValues returns the recordable fields of a model
+func auditValues(m interface{}) map[string]interface{} {
+	out := make(map[string]interface{})
+	v := reflect.ValueOf(m)
+	for _, r := range planOf(v.Type()).fields {
+		if r.hidden || r.writeOnly {
+			continue
+		}
+		if fv, ok := fieldByIndex(v, r.index); ok {
+			out[r.name] = fv.Interface()
+		}
+	}
+	return out
+}
+
+// auditChanges keeps the fields whose values differ between before and after
+func auditChanges(before, after map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	b, a := make(map[string]interface{}), make(map[string]interface{})
+	for k, v := range after {
+		old, _ := json.Marshal(before[k])
+		now, _ := json.Marshal(v)
+		if string(old) != string(now) {
+			b[k], a[k] = before[k], v
+		}
+	}
+	return b, a
+}
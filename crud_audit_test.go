@@ -0,0 +1,208 @@
+package aqua
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type ledger struct {
+	Id      int    `json:"id"`
+	Account string `json:"account"`
+	Amount  int    `json:"amount"`
+	Pin     string `json:"pin" aqua:"writeonly"`
+}
+
+type auditService struct {
+	RestService `root:"audit-test"`
+	ledgers     CRUD `mods:"user"`
+	drafts      CRUD `mods:"user"`
+	db          string
+	file        string
+}
+
+func (s *auditService) Ledgers() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "sqlite3", Conn: s.db},
+		Model: func() (interface{}, interface{}) {
+			return &ledger{}, &[]ledger{}
+		},
+		Audit: AuditTable(cstr.Storage{Engine: "sqlite3", Conn: s.db}),
+		Admin: "role:admin",
+	}
+}
+
+func (s *auditService) Drafts() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "memory", Conn: "audit-test"},
+		Model: func() (interface{}, interface{}) {
+			return &ledger{}, &[]ledger{}
+		},
+		Audit: AuditFile(s.file),
+		Admin: "role:admin",
+	}
+}
+
+// modUser sets the principal from the X-User header
+func modUser() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, WithPrincipal(r, Principal{Id: r.Header.Get("X-User")}))
+		})
+	}
+}
+
+func TestCrudAudit(t *testing.T) {
+
+	db, _ := ioutil.TempFile("", "audit")
+	db.Close()
+	defer os.Remove(db.Name())
+	g, _ := gorm.Open("sqlite3", db.Name())
+	g.AutoMigrate(&ledger{})
+	g.Close()
+
+	file, _ := ioutil.TempFile("", "audit-log")
+	file.Close()
+	defer os.Remove(file.Name())
+
+	s := NewRestServer()
+	s.SetAuth(roleAuth{})
+	s.AddModule("user", modUser())
+	s.AddService(&auditService{db: db.Name(), file: file.Name()})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	call := func(method, path, body string, headers ...string) (int, string) {
+		url := fmt.Sprintf("http://localhost:%d%s", s.Port, path)
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	entries := func(query string) []AuditEntry {
+		code, body := call("GET", "/aqua/audit?"+query, "", "X-Role", "admin")
+		So(code, ShouldEqual, 200)
+		out := make([]AuditEntry, 0)
+		So(json.Unmarshal([]byte(body), &out), ShouldBeNil)
+		return out
+	}
+
+	for _, res := range []string{"ledgers", "drafts"} {
+		path := "/audit-test/" + res
+		call("POST", path, `{"id":1,"account":"acme","amount":10,"pin":"1234"}`, "X-User", "alice", "X-Request-Id", "r-1")
+		call("PUT", path+"/1", `{"amount":25}`, "X-User", "bob")
+		call("PUT", path+"/2", `{"amount":30}`, "X-User", "bob")
+		call("DELETE", path+"/1", "", "X-User", "carol")
+
+		Convey("Given writes to an audited "+res+" crud", t, func() {
+
+			Convey("Then each should be recorded, newest first", func() {
+				es := entries("resource=audit-test/" + res)
+				So(len(es), ShouldEqual, 3)
+				So(es[0].Action, ShouldEqual, "delete")
+				So(es[0].Who, ShouldEqual, "carol")
+				So(es[0].Before["amount"], ShouldEqual, 25)
+				So(es[0].After, ShouldBeNil)
+
+				So(es[1].Action, ShouldEqual, "update")
+				So(es[1].Who, ShouldEqual, "bob")
+				So(es[1].RequestId, ShouldNotBeEmpty)
+				So(es[1].Before, ShouldResemble, map[string]interface{}{"amount": 10.0})
+				So(es[1].After, ShouldResemble, map[string]interface{}{"amount": 25.0})
+
+				So(es[2].Action, ShouldEqual, "create")
+				So(es[2].Key, ShouldEqual, "1")
+				So(es[2].RequestId, ShouldEqual, "r-1")
+				So(es[2].After["account"], ShouldEqual, "acme")
+				So(es[2].After, ShouldNotContainKey, "pin")
+			})
+			Convey("Then entries can be selected by key and paged", func() {
+				So(len(entries("resource=audit-test/"+res+"&key=2")), ShouldEqual, 0)
+				es := entries("resource=audit-test/" + res + "&key=1&limit=1&offset=1")
+				So(len(es), ShouldEqual, 1)
+				So(es[0].Action, ShouldEqual, "update")
+			})
+			Convey("Then the trail should be for admins only", func() {
+				code, _ := call("GET", "/aqua/audit?resource=audit-test/"+res, "")
+				So(code, ShouldEqual, 403)
+			})
+		})
+	}
+
+	Convey("Given a resource without audit", t, func() {
+		code, _ := call("GET", "/aqua/audit?resource=nothing/here", "", "X-Role", "admin")
+		So(code, ShouldEqual, 404)
+	})
+
+	Convey("Given an audit callback", t, func() {
+		seen := make([]AuditEntry, 0)
+		c := &CRUD{
+			Storage: cstr.Storage{Engine: "memory", Conn: "audit-func"},
+			Model: func() (interface{}, interface{}) {
+				return &ledger{}, &[]ledger{}
+			},
+			Audit: AuditFunc(func(e AuditEntry) error {
+				seen = append(seen, e)
+				return nil
+			}),
+			resource: "ledgers",
+		}
+		c.validate()
+
+		r, _ := http.NewRequest("POST", "/ledgers", strings.NewReader(`{"account":"x"}`))
+		c.Memory_Create(NewAide(nil, r))
+
+		Convey("Then it should be called with the entry", func() {
+			So(len(seen), ShouldEqual, 1)
+			So(seen[0].Resource, ShouldEqual, "ledgers")
+			So(seen[0].Action, ShouldEqual, "create")
+		})
+	})
+
+	Convey("Given an audit sink that fails", t, func() {
+		var failed error
+		c := &CRUD{
+			Storage: cstr.Storage{Engine: "memory", Conn: "audit-func"},
+			Model: func() (interface{}, interface{}) {
+				return &ledger{}, &[]ledger{}
+			},
+			Audit: AuditFunc(func(e AuditEntry) error {
+				return fmt.Errorf("sink down")
+			}),
+			auditFailed: func(e AuditEntry, err error) {
+				failed = err
+			},
+		}
+		c.validate()
+
+		r, _ := http.NewRequest("POST", "/ledgers", strings.NewReader(`{"account":"y"}`))
+		c.Memory_Create(NewAide(nil, r))
+
+		Convey("Then the failure hook should be told", func() {
+			So(failed, ShouldNotBeNil)
+			So(failed.Error(), ShouldEqual, "sink down")
+		})
+	})
+
+	Convey("Given audit on a key value engine", t, func() {
+		c := CRUD{Storage: cstr.Storage{Engine: "memcache", Conn: "localhost:11211"}, Audit: AuditFunc(nil)}
+		Convey("Then validation should fail", func() {
+			So(c.validate, ShouldPanic)
+		})
+	})
+}
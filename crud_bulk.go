@@ -0,0 +1,624 @@
+package aqua
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/db/orm"
+	"github.com/mayur-tolexo/aero/refl"
+)
+
+// GET {crud}/export streams the rows of a filtered list (same filters and
+// order as the list endpoint) as csv, or as newline delimited json with
+// ?format=ndjson. Rows are read from the database one at a time, and only
+// the fields the caller may read (and asked for via ?fields=) are written.
+//
+// POST {crud}/import loads rows from a csv or ndjson upload (the request
+// body, or the form file named "file"). The csv header (or the json keys)
+// are matched to the json name, field name or column of the model, and can
+// be mapped explicitly with ?map=Header:field,Other:- where "-" skips a
+// column. All rows are imported in one transaction, and none are if any
+// row fails. The response is a report of the rows with errors; with
+// ?dry_run=true rows are only validated (hooks and database constraints
+// included) and then rolled back.
+
+const (
+	exportFlushEvery = 100
+	importMaxErrors  = 100
+	importMaxLine    = 1 << 20
+)
+
+var errImportRollback = errors.New("import rolled back")
+
+func bulkFormat(r *http.Request) (string, error) {
+	f := strings.ToLower(r.URL.Query().Get("format"))
+	if f == "" && r.Method == "POST" {
+		ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if strings.Contains(ct, "ndjson") || strings.Contains(ct, "jsonl") {
+			f = "ndjson"
+		}
+	}
+	switch f {
+	case "", "csv":
+		return "csv", nil
+	case "ndjson", "jsonl":
+		return "ndjson", nil
+	}
+	return "", badParam("Unknown format " + f + ", use csv or ndjson")
+}
+
+func (c *CRUD) writeFault(w http.ResponseWriter, r *http.Request, err error) {
+	f := hookFault(err).(Fault)
+	writeItem(w, r, refl.ObjSignature(f), reflect.ValueOf(f), c.Pretty)
+}
+
+type exporter struct {
+	w      http.ResponseWriter
+	format string
+	rules  []fieldRule
+	csv    *csv.Writer
+	enc    *json.Encoder
+	plan   *fieldPlan
+	who    Principal
+	fields []string
+	n      int
+}
+
+func newExporter(w http.ResponseWriter, r *http.Request, m interface{}) (*exporter, error) {
+	format, err := bulkFormat(r)
+	if err != nil {
+		return nil, err
+	}
+	e := &exporter{
+		w:      w,
+		format: format,
+		plan:   planOf(reflect.TypeOf(m)),
+		who:    principalOf(r),
+		fields: requestedFields(r),
+	}
+	if e.fields != nil {
+		if _, err := e.plan.columns(e.fields, e.who); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range e.plan.fields {
+		if rule.readableBy(e.who) && wanted(rule.name, e.fields) {
+			e.rules = append(e.rules, rule)
+		}
+	}
+	return e, nil
+}
+
+func (e *exporter) begin(name string) {
+	h := e.w.Header()
+	if e.format == "csv" {
+		h.Set("Content-Type", "text/csv; charset=utf-8")
+		h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+		e.csv = csv.NewWriter(e.w)
+		head := make([]string, len(e.rules))
+		for i, r := range e.rules {
+			head[i] = r.name
+		}
+		e.csv.Write(head)
+	} else {
+		h.Set("Content-Type", "application/x-ndjson")
+		h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.ndjson"`, name))
+		e.enc = json.NewEncoder(e.w)
+	}
+	e.w.WriteHeader(200)
+}
+
+func (e *exporter) write(m interface{}) error {
+	v := reflect.ValueOf(m)
+	var err error
+	if e.format == "csv" {
+		rec := make([]string, len(e.rules))
+		for i, r := range e.rules {
+			if fv, ok := fieldByIndex(v, r.index); ok {
+				rec[i] = csvValue(scope(fv, e.who))
+			}
+		}
+		err = e.csv.Write(rec)
+	} else {
+		err = e.enc.Encode(e.plan.view(v, e.who, e.fields))
+	}
+	if e.n++; e.n%exportFlushEvery == 0 {
+		e.flush()
+	}
+	return err
+}
+
+func (e *exporter) flush() {
+	if e.csv != nil {
+		e.csv.Flush()
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// end finishes the export, or aborts it if err is set
+func (e *exporter) end(err error) {
+	e.flush()
+	if err == nil && e.csv != nil {
+		err = e.csv.Error()
+	}
+	if err != nil {
+		// the status is out already, so the response is cut short for the
+		// client to see that the file is incomplete
+		log.Println("aqua: export failed:", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func csvValue(v reflect.Value) string {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).Format(time.RFC3339)
+	}
+	switch v.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		b, _ := json.Marshal(v.Interface())
+		return string(b)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func (c *CRUD) Rdbms_Export(w http.ResponseWriter, r *http.Request) {
+	j := Aide{Request: r, Response: w}
+	m, _ := c.Model()
+	q := r.URL.Query()
+
+	ex, err := newExporter(w, r, m)
+	if err != nil {
+		c.writeFault(w, r, err)
+		return
+	}
+	fs, err := c.filters(m, q)
+	if err != nil {
+		c.writeFault(w, r, err)
+		return
+	}
+	ord, err := c.order(m, q)
+	if err != nil {
+		c.writeFault(w, r, err)
+		return
+	}
+
+	dbo := c.readConn(j)
+	qry := c.withDeleted(c.scope(dbo.Model(m), j), j)
+	for _, f := range fs {
+		qry = f.apply(qry)
+	}
+	if ord != "" {
+		qry = qry.Order(ord)
+	}
+	if q.Get("limit") != "" || q.Get("offset") != "" {
+		lim, off, err := page(q)
+		if err != nil {
+			c.writeFault(w, r, err)
+			return
+		}
+		qry = qry.Limit(lim).Offset(off)
+	}
+
+	rows, err := qry.Rows()
+	if err != nil {
+		c.writeFault(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	ex.begin(dbo.NewScope(m).TableName())
+	for rows.Next() {
+		row, _ := c.Model()
+		if err = dbo.ScanRows(rows, row); err == nil {
+			err = ex.write(row)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	ex.end(err)
+}
+
+func (c *CRUD) Memory_Export(w http.ResponseWriter, r *http.Request) {
+	j := Aide{Request: r, Response: w}
+	m, _ := c.Model()
+	q := r.URL.Query()
+
+	ex, err := newExporter(w, r, m)
+	if err != nil {
+		c.writeFault(w, r, err)
+		return
+	}
+	ord, err := c.order(m, q)
+	if err != nil {
+		c.writeFault(w, r, err)
+		return
+	}
+	rows, err := c.memRows(m, j)
+	if err != nil {
+		c.writeFault(w, r, err)
+		return
+	}
+	memSort(m, ord, rows)
+	if q.Get("limit") != "" || q.Get("offset") != "" {
+		lim, off, err := page(q)
+		if err != nil {
+			c.writeFault(w, r, err)
+			return
+		}
+		rows = memPage(rows, lim, off)
+	}
+
+	ex.begin(strings.ToLower(reflect.TypeOf(m).Elem().Name()))
+	for _, row := range rows {
+		if err = ex.write(row); err != nil {
+			break
+		}
+	}
+	ex.end(err)
+}
+
+type importError struct {
+	Line    int    `json:"line"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+type importReport struct {
+	DryRun   bool          `json:"dry_run"`
+	Rows     int           `json:"rows"`
+	Imported int           `json:"imported"`
+	Errors   []importError `json:"errors"`
+}
+
+func (rep *importReport) fail(line int, field string, err error) {
+	if len(rep.Errors) < importMaxErrors {
+		rep.Errors = append(rep.Errors, importError{Line: line, Field: field, Message: err.Error()})
+	}
+}
+
+// result returns the status and body of the import response
+func (rep *importReport) result() (int, interface{}) {
+	code, ok := 200, 1
+	if len(rep.Errors) > 0 {
+		code, ok = 422, 0
+	}
+	return code, map[string]interface{}{
+		"success":  ok,
+		"dry_run":  rep.DryRun,
+		"rows":     rep.Rows,
+		"imported": rep.Imported,
+		"errors":   rep.Errors,
+	}
+}
+
+// rejected is the response to an upload that cannot be read at all
+func rejected(err error) (int, interface{}) {
+	rep := &importReport{Errors: make([]importError, 0)}
+	rep.fail(0, "", err)
+	code, out := rep.result()
+	if f, ok := err.(Fault); ok && f.HTTPCode != 0 {
+		code = f.HTTPCode
+	}
+	return code, out
+}
+
+func dryRun(r *http.Request) bool {
+	v := r.URL.Query().Get("dry_run")
+	return v == "true" || v == "1"
+}
+
+// importSource returns the uploaded file
+func importSource(r *http.Request) (io.Reader, error) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "multipart/form-data" {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, badParam("Form file named file is missing")
+		}
+		return f, nil
+	}
+	return r.Body, nil
+}
+
+// importMapping parses ?map=Header:field,Other:-
+func importMapping(r *http.Request) map[string]string {
+	out := make(map[string]string)
+	spec := r.URL.Query().Get("map")
+	if spec == "" {
+		return out
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		if kv := strings.SplitN(pair, ":", 2); len(kv) == 2 {
+			out[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+		}
+	}
+	return out
+}
+
+// importRule finds the writable field of a model for an upload column. It
+// returns nil for columns that are to be skipped.
+func importRule(p *fieldPlan, name string, mapping map[string]string) (*fieldRule, error) {
+	if to, found := mapping[strings.ToLower(name)]; found {
+		if to == "-" {
+			return nil, nil
+		}
+		name = to
+	}
+	for i, r := range p.fields {
+		if strings.EqualFold(r.name, name) || strings.EqualFold(r.column, name) || gorm.ToDBName(name) == r.column {
+			if r.hidden {
+				break
+			}
+			return &p.fields[i], nil
+		}
+	}
+	return nil, badParam("Unknown column " + name)
+}
+
+// setCell sets a field from its text in a csv upload
+func setCell(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Ptr {
+		nv := reflect.New(v.Type().Elem())
+		if err := setCell(nv.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(nv)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		if v.Type() != timeType {
+			return json.Unmarshal([]byte(s), v.Addr().Interface())
+		}
+	}
+	pv, err := parseAs(v.Type(), s)
+	if err != nil {
+		return err
+	}
+	v.Set(pv)
+	return nil
+}
+
+// importRows reads the upload and hands each row, as a new model, to save.
+// Once a row has failed, save is told (ok=false) that it should only
+// validate, as nothing is going to be imported.
+func (c *CRUD) importRows(j Aide, rep *importReport, save func(m interface{}, ok bool) error) error {
+	format, err := bulkFormat(j.Request)
+	if err != nil {
+		return err
+	}
+	src, err := importSource(j.Request)
+	if err != nil {
+		return err
+	}
+	m, _ := c.Model()
+	p := planOf(reflect.TypeOf(m))
+	mapping := importMapping(j.Request)
+
+	handle := func(line int, m interface{}) {
+		rep.Rows++
+		p.scrub(m)
+		if err := c.adopt(m, j); err != nil {
+			rep.fail(line, c.Parent.Column, err)
+			return
+		}
+		if err := save(m, len(rep.Errors) == 0); err != nil {
+			rep.fail(line, "", err)
+			return
+		}
+		if len(rep.Errors) == 0 {
+			rep.Imported++
+		}
+	}
+
+	if format == "csv" {
+		rd := csv.NewReader(src)
+		head, err := rd.Read()
+		if err == io.EOF {
+			return badParam("The upload is empty")
+		} else if err != nil {
+			return badParam(err.Error())
+		}
+		rules := make([]*fieldRule, len(head))
+		for i, h := range head {
+			if rules[i], err = importRule(p, strings.TrimSpace(h), mapping); err != nil {
+				return err
+			}
+		}
+		for line := 2; ; line++ {
+			rec, err := rd.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return badParam(err.Error())
+			}
+			m, _ := c.Model()
+			ok := true
+			for i, cell := range rec {
+				if i >= len(rules) || rules[i] == nil || cell == "" {
+					continue
+				}
+				fv, _ := fieldByIndex(reflect.ValueOf(m), rules[i].index)
+				if err := setCell(fv, cell); err != nil {
+					rep.fail(line, rules[i].name, fmt.Errorf("invalid value %q", cell))
+					ok = false
+				}
+			}
+			if ok {
+				handle(line, m)
+			} else {
+				rep.Rows++
+			}
+		}
+		return nil
+	}
+
+	sc := bufio.NewScanner(src)
+	sc.Buffer(make([]byte, 64*1024), importMaxLine)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &data); err != nil {
+			rep.Rows++
+			rep.fail(line, "", errors.New("invalid json"))
+			continue
+		}
+		byName := make(map[string]interface{})
+		ok := true
+		for k, v := range data {
+			r, err := importRule(p, k, mapping)
+			if err != nil {
+				rep.fail(line, k, err)
+				ok = false
+			} else if r != nil {
+				byName[r.name] = v
+			}
+		}
+		m, _ := c.Model()
+		if ok {
+			b, _ := json.Marshal(byName)
+			if err := json.Unmarshal(b, m); err != nil {
+				rep.fail(line, "", err)
+				ok = false
+			}
+		}
+		if ok {
+			handle(line, m)
+		} else {
+			rep.Rows++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return badParam(err.Error())
+	}
+	return nil
+}
+
+func (c *CRUD) Rdbms_Import(j Aide) (int, interface{}) {
+	rep := &importReport{DryRun: dryRun(j.Request), Errors: make([]importError, 0)}
+	created := make([]interface{}, 0)
+
+	run := func(tx *gorm.DB) error {
+		err := c.importRows(j, rep, func(m interface{}, ok bool) error {
+			h := c.newHook(j, m, tx)
+			if err := c.hook("beforeCreate", h); err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+			if err := tx.Create(m).Error; err != nil {
+				return err
+			}
+			created = append(created, m)
+			return c.hook("afterCreate", h)
+		})
+		if err != nil {
+			return err
+		}
+		if rep.DryRun || len(rep.Errors) > 0 {
+			return errImportRollback
+		}
+		return nil
+	}
+
+	var err error
+	if rep.DryRun {
+		// a transaction of its own, which is always rolled back
+		err = withTx(orm.GetConn(c.Engine, c.Conn), run)
+	} else {
+		err = c.inTx(j, run)
+	}
+	if err != nil && err != errImportRollback {
+		return rejected(err)
+	}
+	if rep.DryRun || len(rep.Errors) > 0 {
+		rep.Imported = 0
+	} else {
+		for _, m := range created {
+			c.audit(j, "create", keyString(m), nil, auditValues(m))
+		}
+		c.pin(j)
+	}
+	return rep.result()
+}
+
+func (c *CRUD) Memory_Import(j Aide) (int, interface{}) {
+	rep := &importReport{DryRun: dryRun(j.Request), Errors: make([]importError, 0)}
+	m, _ := c.Model()
+	t, _ := memTableOf(c.Conn, m)
+
+	// rows are staged, and stored only once all of them are fine
+	staged := make([]*Hook, 0)
+	keys := make(map[string]bool)
+	err := c.importRows(j, rep, func(m interface{}, ok bool) error {
+		h := c.newHook(j, m, nil)
+		if err := c.hook("beforeCreate", h); err != nil {
+			return err
+		}
+		if pk, err := primaryField(m); err == nil && (!isEmptyValue(pk) || keyVars(m) != nil) {
+			key := keyString(m)
+			if _, found := t.get(key); found || keys[key] {
+				return fmt.Errorf("key %s already exists", key)
+			}
+			keys[key] = true
+		}
+		staged = append(staged, h)
+		return nil
+	})
+	if err != nil {
+		return rejected(err)
+	}
+	if rep.DryRun || len(rep.Errors) > 0 {
+		rep.Imported = 0
+		return rep.result()
+	}
+
+	done := make([]string, 0, len(staged))
+	for _, h := range staged {
+		key, err := t.insert(h.Model)
+		if err == nil {
+			h.Pkey = key
+			done = append(done, key)
+			err = c.hook("afterCreate", h)
+		}
+		if err != nil {
+			for _, k := range done {
+				t.remove(k)
+			}
+			rep.Imported = 0
+			rep.fail(0, "", err)
+			return rep.result()
+		}
+	}
+	for _, h := range staged {
+		c.audit(j, "create", h.Pkey, nil, auditValues(h.Model))
+	}
+	return rep.result()
+}
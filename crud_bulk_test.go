@@ -0,0 +1,194 @@
+package aqua
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type part struct {
+	Id    int     `json:"id"`
+	Name  string  `json:"name"`
+	Stock int     `json:"stock"`
+	Price float64 `json:"price"`
+	Cost  float64 `json:"cost" aqua:"hidden"`
+}
+
+type bulkService struct {
+	RestService `root:"bulk"`
+	parts       CRUD
+	stock       CRUD
+	db          string
+}
+
+func (s *bulkService) Parts() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "memory", Conn: "bulk-test"},
+		Model: func() (interface{}, interface{}) {
+			return &part{}, &[]part{}
+		},
+		Columns: []string{"id", "stock"},
+	}
+}
+
+func (s *bulkService) Stock() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "sqlite3", Conn: s.db},
+		Model: func() (interface{}, interface{}) {
+			return &part{}, &[]part{}
+		},
+		Columns: []string{"id", "stock"},
+	}
+}
+
+func TestCrudBulk(t *testing.T) {
+
+	tmp, _ := ioutil.TempFile("", "bulk")
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	db, _ := gorm.Open("sqlite3", tmp.Name())
+	db.AutoMigrate(&part{})
+	db.Close()
+
+	s := NewRestServer()
+	s.AddService(&bulkService{db: tmp.Name()})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	send := func(req *http.Request) (int, string, http.Header) {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error(), nil
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b), resp.Header
+	}
+	call := func(method, path, ctype, body string) (int, string, http.Header) {
+		url := fmt.Sprintf("http://localhost:%d/bulk%s", s.Port, path)
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if ctype != "" {
+			req.Header.Set("Content-Type", ctype)
+		}
+		return send(req)
+	}
+	report := func(body string) map[string]interface{} {
+		out := make(map[string]interface{})
+		json.Unmarshal([]byte(body), &out)
+		return out
+	}
+
+	Convey("Given a csv upload", t, func() {
+		csv := "id,name,stock,price\n1,bolt,100,0.5\n2,nut,200,0.25\n3,gear,5,12\n"
+
+		Convey("Then a dry run should validate without importing", func() {
+			code, body, _ := call("POST", "/parts/import?dry_run=true", "text/csv", csv)
+			So(code, ShouldEqual, 200)
+			So(report(body)["rows"], ShouldEqual, 3)
+			So(report(body)["imported"], ShouldEqual, 0)
+
+			_, body, _ = call("GET", "/parts", "", "")
+			So(body, ShouldEqual, "[]")
+		})
+		Convey("Then it should be imported once", func() {
+			code, body, _ := call("POST", "/parts/import", "text/csv", csv)
+			So(code, ShouldEqual, 200)
+			So(report(body)["imported"], ShouldEqual, 3)
+
+			code, body, _ = call("POST", "/parts/import", "text/csv", csv)
+			So(code, ShouldEqual, 422)
+			So(report(body)["errors"], ShouldHaveLength, 3)
+		})
+	})
+
+	Convey("Given imported rows", t, func() {
+
+		Convey("Then they should be exported as csv", func() {
+			code, body, h := call("GET", "/parts/export?stock.gte=100&order=-stock", "", "")
+			So(code, ShouldEqual, 200)
+			So(h.Get("Content-Type"), ShouldStartWith, "text/csv")
+			So(body, ShouldEqual, "id,name,stock,price\n2,nut,200,0.25\n1,bolt,100,0.5\n")
+		})
+		Convey("Then they should be exported as ndjson with selected fields", func() {
+			code, body, _ := call("GET", "/parts/export?format=ndjson&fields=name&order=id", "", "")
+			So(code, ShouldEqual, 200)
+			So(body, ShouldEqual, "{\"name\":\"bolt\"}\n{\"name\":\"nut\"}\n{\"name\":\"gear\"}\n")
+		})
+	})
+
+	Convey("Given an upload with bad rows", t, func() {
+		csv := "Part,Qty,Notes\nwasher,ten,x\nspring,4,y\n"
+
+		Convey("Then the report should list them, and nothing is imported", func() {
+			code, body, _ := call("POST", "/stock/import?map=Part:name,Qty:stock,Notes:-", "text/csv", csv)
+			So(code, ShouldEqual, 422)
+			errs := report(body)["errors"].([]interface{})
+			So(errs, ShouldHaveLength, 1)
+			So(errs[0].(map[string]interface{})["line"], ShouldEqual, 2)
+			So(errs[0].(map[string]interface{})["field"], ShouldEqual, "stock")
+
+			_, body, _ = call("GET", "/stock", "", "")
+			So(body, ShouldEqual, "[]")
+		})
+		Convey("Then unmapped headers should be rejected", func() {
+			code, _, _ := call("POST", "/stock/import", "text/csv", csv)
+			So(code, ShouldEqual, 400)
+		})
+		Convey("Then hidden fields should not be importable", func() {
+			code, _, _ := call("POST", "/stock/import", "text/csv", "name,cost\na,1\n")
+			So(code, ShouldEqual, 400)
+		})
+	})
+
+	Convey("Given an ndjson file upload", t, func() {
+		buf := &bytes.Buffer{}
+		mw := multipart.NewWriter(buf)
+		fw, _ := mw.CreateFormFile("file", "stock.ndjson")
+		fw.Write([]byte("{\"id\":7,\"name\":\"cog\",\"stock\":3}\n\n{\"id\":8,\"name\":\"pin\",\"stock\":9}\n"))
+		mw.Close()
+
+		url := fmt.Sprintf("http://localhost:%d/bulk/stock/import?format=ndjson", s.Port)
+		req, _ := http.NewRequest("POST", url, buf)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+
+		Convey("Then its rows should be stored in the database", func() {
+			code, body, _ := send(req)
+			So(code, ShouldEqual, 200)
+			So(report(body)["imported"], ShouldEqual, 2)
+
+			_, body, _ = call("GET", "/stock/export?format=ndjson&order=id", "", "")
+			So(body, ShouldEqual, "{\"id\":7,\"name\":\"cog\",\"price\":0,\"stock\":3}\n{\"id\":8,\"name\":\"pin\",\"price\":0,\"stock\":9}\n")
+		})
+	})
+
+	Convey("Given an unknown export format", t, func() {
+		code, _, _ := call("GET", "/parts/export?format=xml", "", "")
+		So(code, ShouldEqual, 400)
+	})
+
+	Convey("Given a row that cannot be exported", t, func() {
+		tbl, _ := memTableOf("bulk-test", &part{})
+		key, _ := tbl.insert(&part{Name: "odd", Price: math.NaN()})
+		defer tbl.remove(key)
+
+		Convey("Then the export should be cut short for the client to see", func() {
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%d/bulk/parts/export?format=ndjson&order=id", s.Port))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, 200)
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,184 @@
+package aqua
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Listing and aggregation take their filters from the query string. Only the
+// columns whitelisted in CRUD.Columns can be used, and values are always
+// passed to the database as parameters:
+//
+//   ?status=open               status = 'open'
+//   ?amount.gte=10             amount >= 10
+//   ?region.in=north,south     region IN ('north','south')
+//   ?closed_at.null=true       closed_at IS NULL
+//
+// Supported operators: eq, ne, gt, gte, lt, lte, like, in, null
+
+var filterOps = map[string]string{
+	"eq":   "%s = ?",
+	"ne":   "%s <> ?",
+	"gt":   "%s > ?",
+	"gte":  "%s >= ?",
+	"lt":   "%s < ?",
+	"lte":  "%s <= ?",
+	"like": "%s LIKE ?",
+	"in":   "%s IN (?)",
+	"null": "",
+}
+
+// query params that are never treated as filters
+var reservedParams = map[string]bool{
+	"fields":  true,
+	"include": true,
+	"limit":   true,
+	"offset":  true,
+	"order":   true,
+	"agg":     true,
+	"by":      true,
+
+	"include_deleted": true,
+}
+
+const listLimit = 100
+const listLimitMax = 1000
+
+type filter struct {
+	column string
+	op     string
+	values []string
+}
+
+func (f filter) apply(db *gorm.DB) *gorm.DB {
+	switch f.op {
+	case "in":
+		return db.Where(fmt.Sprintf(filterOps[f.op], f.column), f.values)
+	case "null":
+		if f.values[0] == "false" || f.values[0] == "0" {
+			return db.Where(fmt.Sprintf("%s IS NOT NULL", f.column))
+		}
+		return db.Where(fmt.Sprintf("%s IS NULL", f.column))
+	}
+	return db.Where(fmt.Sprintf(filterOps[f.op], f.column), f.values[0])
+}
+
+func validateColumns(m interface{}, cols []string) {
+	p := planOf(reflect.TypeOf(m))
+	for _, c := range cols {
+		if _, ok := p.column(c); !ok {
+			panic(fmt.Sprintf("Crud column %s not found in model", c))
+		}
+	}
+}
+
+// column resolves a field (json name, field name or column) to its db column
+func (p *fieldPlan) column(name string) (string, bool) {
+	for _, r := range p.fields {
+		if r.name == name || r.column == name || gorm.ToDBName(name) == r.column {
+			return r.column, true
+		}
+	}
+	return "", false
+}
+
+// whitelisted returns the db column for a name, if it can be filtered on
+func (c *CRUD) whitelisted(m interface{}, name string) (string, bool) {
+	p := planOf(reflect.TypeOf(m))
+	col, ok := p.column(name)
+	if !ok {
+		return "", false
+	}
+	for _, w := range c.Columns {
+		if wc, _ := p.column(w); wc == col {
+			return col, true
+		}
+	}
+	return "", false
+}
+
+func badParam(msg string) error {
+	return Fault{
+		HTTPCode: 400,
+		Message:  msg,
+		Issue:    errors.New(msg),
+	}
+}
+
+// filters parses the filters found in the query string
+func (c *CRUD) filters(m interface{}, q url.Values) ([]filter, error) {
+	out := make([]filter, 0)
+	for k, v := range q {
+		if reservedParams[k] {
+			continue
+		}
+		name, op := k, "eq"
+		if dot := strings.LastIndex(k, "."); dot > 0 {
+			name, op = k[:dot], k[dot+1:]
+		}
+		if _, found := planOf(reflect.TypeOf(m)).column(name); !found {
+			// not meant for us
+			continue
+		}
+		col, ok := c.whitelisted(m, name)
+		if !ok {
+			return nil, badParam("Cannot filter on " + name)
+		}
+		if _, ok := filterOps[op]; !ok {
+			return nil, badParam("Unknown filter operator " + op)
+		}
+		vals := v
+		if op == "in" {
+			vals = strings.Split(strings.Join(v, ","), ",")
+		}
+		out = append(out, filter{column: col, op: op, values: vals})
+	}
+	return out, nil
+}
+
+// order parses ?order=name,-amount into an order by clause
+func (c *CRUD) order(m interface{}, q url.Values) (string, error) {
+	ord := q.Get("order")
+	if ord == "" {
+		return "", nil
+	}
+	out := make([]string, 0)
+	for _, o := range strings.Split(ord, ",") {
+		o = strings.TrimSpace(o)
+		dir := ""
+		if strings.HasPrefix(o, "-") {
+			o, dir = o[1:], " desc"
+		}
+		col, ok := c.whitelisted(m, o)
+		if !ok {
+			return "", badParam("Cannot order by " + o)
+		}
+		out = append(out, col+dir)
+	}
+	return strings.Join(out, ","), nil
+}
+
+// page parses ?limit and ?offset
+func page(q url.Values) (limit int, offset int, err error) {
+	limit = listLimit
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			return 0, 0, badParam("limit must be a positive integer")
+		}
+		if limit > listLimitMax {
+			limit = listLimitMax
+		}
+	}
+	if s := q.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return 0, 0, badParam("offset must be a non negative integer")
+		}
+	}
+	return limit, offset, nil
+}
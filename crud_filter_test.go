@@ -0,0 +1,131 @@
+package aqua
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type sale struct {
+	Id     int
+	Region string
+	Status string
+	Amount float64
+	Secret string
+}
+
+type salesService struct {
+	RestService
+	sales CRUD
+}
+
+func (s *salesService) Sales() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "mysql", Conn: "blah"},
+		Model: func() (interface{}, interface{}) {
+			return &sale{}, &[]sale{}
+		},
+		Columns: []string{"region", "Status", "amount"},
+	}
+}
+
+func TestCrudFilters(t *testing.T) {
+
+	c := CRUD{Columns: []string{"region", "Status", "amount"}}
+	m := &sale{}
+
+	Convey("Given a CRUD with whitelisted columns", t, func() {
+		Convey("Then filters on whitelisted columns should be parsed", func() {
+			q, _ := url.ParseQuery("status=open&amount.gte=10&region.in=north,south&limit=5")
+			fs, err := c.filters(m, q)
+			So(err, ShouldBeNil)
+			So(len(fs), ShouldEqual, 3)
+			for _, f := range fs {
+				switch f.column {
+				case "status":
+					So(f.op, ShouldEqual, "eq")
+				case "amount":
+					So(f.op, ShouldEqual, "gte")
+				case "region":
+					So(f.values, ShouldResemble, []string{"north", "south"})
+				}
+			}
+		})
+		Convey("Then filters on other model columns should be rejected", func() {
+			q, _ := url.ParseQuery("secret=x")
+			_, err := c.filters(m, q)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Then unknown operators should be rejected", func() {
+			q, _ := url.ParseQuery("amount.between=1")
+			_, err := c.filters(m, q)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Then params that are not model columns should be ignored", func() {
+			q, _ := url.ParseQuery("_=123")
+			fs, err := c.filters(m, q)
+			So(err, ShouldBeNil)
+			So(len(fs), ShouldEqual, 0)
+		})
+		Convey("Then order should accept whitelisted columns only", func() {
+			q, _ := url.ParseQuery("order=region,-amount")
+			ord, err := c.order(m, q)
+			So(err, ShouldBeNil)
+			So(ord, ShouldEqual, "region,amount desc")
+
+			q, _ = url.ParseQuery("order=secret")
+			_, err = c.order(m, q)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Then limit should be capped", func() {
+			q, _ := url.ParseQuery("limit=100000&offset=20")
+			lim, off, err := page(q)
+			So(err, ShouldBeNil)
+			So(lim, ShouldEqual, listLimitMax)
+			So(off, ShouldEqual, 20)
+		})
+	})
+
+	Convey("Given an aggregate request", t, func() {
+		Convey("Then aggregates and groups should be parsed", func() {
+			q, _ := url.ParseQuery("agg=count,sum(amount),max(amount)&by=region")
+			aggs, err := c.aggregates(m, q)
+			So(err, ShouldBeNil)
+			So(len(aggs), ShouldEqual, 3)
+			So(aggs[0].sql(), ShouldEqual, "COUNT(*) AS count")
+			So(aggs[1].sql(), ShouldEqual, "SUM(amount) AS sum_amount")
+
+			grps, err := c.groups(m, q)
+			So(err, ShouldBeNil)
+			So(grps, ShouldResemble, []string{"region"})
+		})
+		Convey("Then aggregates on columns that are not whitelisted should be rejected", func() {
+			q, _ := url.ParseQuery("agg=sum(secret)")
+			_, err := c.aggregates(m, q)
+			So(err, ShouldNotBeNil)
+
+			q, _ = url.ParseQuery("agg=sum")
+			_, err = c.aggregates(m, q)
+			So(err, ShouldNotBeNil)
+
+			q, _ = url.ParseQuery("agg=median(amount)")
+			_, err = c.aggregates(m, q)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a CRUD with a model slice", t, func() {
+		s := NewRestServer()
+		s.AddService(&salesService{})
+		s.loadAllEndpoints()
+
+		Convey("Then list and aggregate endpoints should be setup", func() {
+			_, found := s.apis["GET:/sales/sales"]
+			So(found, ShouldBeTrue)
+			_, found = s.apis["GET:/sales/sales/aggregate"]
+			So(found, ShouldBeTrue)
+		})
+	})
+}
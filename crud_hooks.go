@@ -0,0 +1,177 @@
+package aqua
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/db/orm"
+)
+
+// Hook carries the state of a CRUD operation to the lifecycle hooks.
+// Hooks may be implemented on the service that declares the CRUD field or on
+// the model returned by Model(); the service is consulted first. A hook can
+// alter the Model (or Data for updates) and abort the operation by returning
+// an error, preferably a Fault. On RDBMS engines, write hooks run inside the
+// transaction of the write, which is available as Tx; other engines (redis,
+// memory) have no transactions and leave Tx nil.
+type Hook struct {
+	Aide  Aide
+	Who   Principal
+	Model interface{}
+	Pkey  string
+	Data  map[string]interface{}
+	Tx    *gorm.DB
+}
+
+// The method names carry a Crud prefix since gorm reserves BeforeCreate,
+// AfterCreate etc. for its own callbacks on the model.
+
+type BeforeCreate interface {
+	CrudBeforeCreate(h *Hook) error
+}
+
+type AfterCreate interface {
+	CrudAfterCreate(h *Hook) error
+}
+
+type AfterRead interface {
+	CrudAfterRead(h *Hook) error
+}
+
+type BeforeUpdate interface {
+	CrudBeforeUpdate(h *Hook) error
+}
+
+type AfterUpdate interface {
+	CrudAfterUpdate(h *Hook) error
+}
+
+type BeforeDelete interface {
+	CrudBeforeDelete(h *Hook) error
+}
+
+type AfterDelete interface {
+	CrudAfterDelete(h *Hook) error
+}
+
+// hookFunc returns the hook implemented by target for the given stage, if any
+func hookFunc(target interface{}, stage string) func(*Hook) error {
+	switch stage {
+	case "beforeCreate":
+		if t, ok := target.(BeforeCreate); ok {
+			return t.CrudBeforeCreate
+		}
+	case "afterCreate":
+		if t, ok := target.(AfterCreate); ok {
+			return t.CrudAfterCreate
+		}
+	case "afterRead":
+		if t, ok := target.(AfterRead); ok {
+			return t.CrudAfterRead
+		}
+	case "beforeUpdate":
+		if t, ok := target.(BeforeUpdate); ok {
+			return t.CrudBeforeUpdate
+		}
+	case "afterUpdate":
+		if t, ok := target.(AfterUpdate); ok {
+			return t.CrudAfterUpdate
+		}
+	case "beforeDelete":
+		if t, ok := target.(BeforeDelete); ok {
+			return t.CrudBeforeDelete
+		}
+	case "afterDelete":
+		if t, ok := target.(AfterDelete); ok {
+			return t.CrudAfterDelete
+		}
+	default:
+		panic("Unknown crud hook: " + stage)
+	}
+	return nil
+}
+
+func (c *CRUD) newHook(j Aide, m interface{}, tx *gorm.DB) *Hook {
+	return &Hook{
+		Aide:  j,
+		Who:   principalOf(j.Request),
+		Model: m,
+		Tx:    tx,
+	}
+}
+
+// hasHook checks if the service or the model implement any of the given stages
+func (c *CRUD) hasHook(m interface{}, stages ...string) bool {
+	for _, target := range []interface{}{c.svc, m} {
+		if target == nil {
+			continue
+		}
+		for _, s := range stages {
+			if hookFunc(target, s) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hook runs the given stage on the service and then on the model
+func (c *CRUD) hook(stage string, h *Hook) error {
+	for _, target := range []interface{}{c.svc, h.Model} {
+		if target == nil {
+			continue
+		}
+		if fn := hookFunc(target, stage); fn != nil {
+			if err := fn(h); err != nil {
+				return hookFault(err)
+			}
+		}
+	}
+	return nil
+}
+
+// hookFault makes sure that hooks abort with a Fault
+func hookFault(err error) error {
+	switch f := err.(type) {
+	case Fault:
+		return f
+	case *Fault:
+		return *f
+	}
+	return Fault{
+		HTTPCode: 400,
+		Message:  "Request rejected",
+		Issue:    err,
+	}
+}
+
+// inTx runs fn in the transaction of the request on the crud storage, which
+// aqua commits or rolls back once the endpoint returns (see Aide.Tx). Without
+// an aqua request, fn runs in a transaction of its own.
+func (c *CRUD) inTx(j Aide, fn func(tx *gorm.DB) error) error {
+	if j.txs == nil {
+		return withTx(orm.GetConn(c.Engine, c.Conn), fn)
+	}
+	tx := j.Tx(c.Storage)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return fn(tx)
+}
+
+// withTx runs fn inside a transaction which is committed only if fn succeeds
+func withTx(dbo *gorm.DB, fn func(tx *gorm.DB) error) (err error) {
+	tx := dbo.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
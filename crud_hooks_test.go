@@ -0,0 +1,72 @@
+package aqua
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type hookModel struct {
+	Id        int
+	CreatedBy string
+	trail     []string
+}
+
+func (m *hookModel) CrudBeforeCreate(h *Hook) error {
+	m.trail = append(m.trail, "model")
+	m.CreatedBy = h.Who.Id
+	return nil
+}
+
+func (m *hookModel) CrudBeforeDelete(h *Hook) error {
+	return errors.New("not allowed")
+}
+
+type hookService struct {
+	RestService
+}
+
+func (s *hookService) CrudBeforeCreate(h *Hook) error {
+	h.Model.(*hookModel).trail = append(h.Model.(*hookModel).trail, "service")
+	return nil
+}
+
+func (s *hookService) CrudAfterRead(h *Hook) error {
+	return Fault{HTTPCode: 403, Message: "hidden"}
+}
+
+func TestCrudHooks(t *testing.T) {
+
+	Convey("Given a CRUD with hooks on the service and the model", t, func() {
+		c := CRUD{svc: &hookService{}}
+		r, _ := http.NewRequest("POST", "/users", nil)
+		r = WithPrincipal(r, Principal{Id: "u1"})
+		m := &hookModel{}
+		h := c.newHook(NewAide(nil, r), m, nil)
+
+		Convey("Then the service hook should run before the model hook", func() {
+			So(c.hook("beforeCreate", h), ShouldBeNil)
+			So(m.trail, ShouldResemble, []string{"service", "model"})
+		})
+		Convey("Then hooks should receive the authenticated identity", func() {
+			c.hook("beforeCreate", h)
+			So(m.CreatedBy, ShouldEqual, "u1")
+		})
+		Convey("Then a Fault returned by a hook should be passed on as is", func() {
+			err := c.hook("afterRead", h)
+			So(err, ShouldHaveSameTypeAs, Fault{})
+			So(err.(Fault).HTTPCode, ShouldEqual, 403)
+		})
+		Convey("Then a plain error should be converted to a Fault", func() {
+			err := c.hook("beforeDelete", h)
+			So(err, ShouldHaveSameTypeAs, Fault{})
+			So(err.Error(), ShouldEqual, "not allowed")
+		})
+		Convey("Then stages without hooks should be detected", func() {
+			So(c.hasHook(m, "beforeDelete"), ShouldBeTrue)
+			So(c.hasHook(m, "afterUpdate", "beforeUpdate"), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,111 @@
+package aqua
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The key of a CRUD model is made of the fields tagged gorm:"primary_key",
+// or else of its id field. A single key is served as /{pkey}, while a
+// composite key gets one segment per field, named after the columns (e.g.
+// /{tenant_id}/{sku}). Crud methods receive a composite key as the values
+// joined by "/", and key values are always bound as query parameters.
+
+// keys returns the key fields of the model, in the order of declaration
+func (p *fieldPlan) keys() []fieldRule {
+	out := make([]fieldRule, 0)
+	for _, r := range p.fields {
+		if r.primary {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// keyVars returns the route vars of a composite key, and nil for a single key
+func keyVars(m interface{}) []string {
+	keys := planOf(reflect.TypeOf(m)).keys()
+	if len(keys) < 2 {
+		return nil
+	}
+	out := make([]string, len(keys))
+	for i, r := range keys {
+		out[i] = r.column
+	}
+	return out
+}
+
+// keyString returns the key of a model as found in its urls
+func keyString(m interface{}) string {
+	v := reflect.ValueOf(m)
+	parts := make([]string, 0)
+	for _, r := range planOf(v.Type()).keys() {
+		if fv, ok := fieldByIndex(v, r.index); ok {
+			parts = append(parts, fmt.Sprint(fv.Interface()))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func (c *CRUD) validateKeys(m interface{}) {
+	for _, v := range keyVars(m) {
+		if v == "pkey" || (c.nested() && v == c.Parent.Var) {
+			panic(fmt.Sprintf("Crud key column %s clashes with a route var", v))
+		}
+	}
+}
+
+// whereKey restricts the query to the row with the given key
+func (c *CRUD) whereKey(db *gorm.DB, m interface{}, primKey string) (*gorm.DB, error) {
+	keys := planOf(reflect.TypeOf(m)).keys()
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Model %T has no primary key", m)
+	}
+	vals := []string{primKey}
+	if len(keys) > 1 {
+		vals = strings.Split(primKey, "/")
+	}
+	if len(vals) != len(keys) {
+		return nil, keyNotFound(primKey)
+	}
+
+	scope := db.NewScope(m)
+	v := reflect.ValueOf(m)
+	for i, r := range keys {
+		fv, _ := fieldByIndex(v, r.index)
+		val, err := keyValue(fv.Type(), vals[i])
+		if err != nil {
+			// no row can have such a key
+			return nil, keyNotFound(primKey)
+		}
+		db = db.Where(fmt.Sprintf("%s.%s = ?", scope.QuotedTableName(), scope.Quote(r.column)), val)
+	}
+	return db, nil
+}
+
+// keyValue converts a key from the url to the type of its field. Types that
+// know how to scan themselves (uuids etc) are left to the driver.
+func keyValue(t reflect.Type, s string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool:
+		v, err := parseAs(t, s)
+		if err != nil {
+			return nil, err
+		}
+		return v.Interface(), nil
+	}
+	return s, nil
+}
+
+// spreadKey serves the key of a crud endpoint as one route var per field
+func (e *endPoint) spreadKey(vars []string) {
+	seg := "{" + strings.Join(vars, "}/{") + "}"
+	e.urlWithVersion = strings.Replace(e.urlWithVersion, "{pkey}", seg, 1)
+	e.urlWoVersion = strings.Replace(e.urlWoVersion, "{pkey}", seg, 1)
+	e.keyVars = vars
+}
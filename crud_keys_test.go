@@ -0,0 +1,148 @@
+package aqua
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type stockItem struct {
+	TenantId string `json:"tenant_id" gorm:"primary_key"`
+	Sku      string `json:"sku" gorm:"primary_key"`
+	Qty      int    `json:"qty"`
+}
+
+type session struct {
+	Id   string `json:"id" gorm:"primary_key"`
+	User string `json:"user"`
+}
+
+type keysService struct {
+	RestService
+	stock    CRUD
+	sessions CRUD
+	shelf    CRUD
+	db       string
+}
+
+func (s *keysService) Stock() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "sqlite3", Conn: s.db},
+		Model: func() (interface{}, interface{}) {
+			return &stockItem{}, &[]stockItem{}
+		},
+	}
+}
+
+func (s *keysService) Sessions() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "sqlite3", Conn: s.db},
+		Model: func() (interface{}, interface{}) {
+			return &session{}, &[]session{}
+		},
+	}
+}
+
+func (s *keysService) Shelf() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "memory", Conn: "keys-test"},
+		Model: func() (interface{}, interface{}) {
+			return &stockItem{}, &[]stockItem{}
+		},
+	}
+}
+
+func TestCrudKeys(t *testing.T) {
+
+	tmp, _ := ioutil.TempFile("", "keys")
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	db, _ := gorm.Open("sqlite3", tmp.Name())
+	db.AutoMigrate(&stockItem{}, &session{})
+	db.Create(&session{Id: "6f1c2a9e-0d4b-4c1a-9a51-3b7f0e2d8c44", User: "jdoe"})
+	db.Close()
+
+	s := NewRestServer()
+	s.AddService(&keysService{db: tmp.Name()})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	call := func(method, path, body string) (int, string) {
+		url := fmt.Sprintf("http://localhost:%d/keys%s", s.Port, path)
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	Convey("Given a model with a composite key", t, func() {
+
+		Convey("Then the routes should have a segment per key field", func() {
+			for _, id := range []string{"GET:/keys/stock/{tenant_id}/{sku}", "PUT:/keys/stock/{tenant_id}/{sku}",
+				"DELETE:/keys/stock/{tenant_id}/{sku}", "GET:/keys/shelf/{tenant_id}/{sku}"} {
+				_, found := s.apis[id]
+				So(found, ShouldBeTrue)
+			}
+		})
+
+		for _, res := range []string{"/stock", "/shelf"} {
+			Convey("Then rows of "+res+" should be read and written by their key", func() {
+				call("POST", res, `{"tenant_id":"acme","sku":"a-1","qty":5}`)
+				call("POST", res, `{"tenant_id":"zeta","sku":"a-1","qty":7}`)
+
+				code, body := call("GET", res+"/zeta/a-1", "")
+				So(code, ShouldEqual, 200)
+				So(body, ShouldContainSubstring, `"qty":7`)
+
+				code, _ = call("PUT", res+"/acme/a-1", `{"qty":6}`)
+				So(code, ShouldEqual, 200)
+				_, body = call("GET", res+"/acme/a-1", "")
+				So(body, ShouldContainSubstring, `"qty":6`)
+				_, body = call("GET", res+"/zeta/a-1", "")
+				So(body, ShouldContainSubstring, `"qty":7`)
+
+				code, _ = call("DELETE", res+"/acme/a-1", "")
+				So(code, ShouldEqual, 200)
+				code, _ = call("GET", res+"/acme/a-1", "")
+				So(code, ShouldEqual, 404)
+				call("DELETE", res+"/zeta/a-1", "")
+			})
+		}
+	})
+
+	Convey("Given a model with a uuid key", t, func() {
+
+		Convey("Then it should be read by its key", func() {
+			code, body := call("GET", "/sessions/6f1c2a9e-0d4b-4c1a-9a51-3b7f0e2d8c44", "")
+			So(code, ShouldEqual, 200)
+			So(body, ShouldContainSubstring, "jdoe")
+		})
+		Convey("Then a key should never be taken as sql", func() {
+			code, _ := call("GET", "/sessions/1%20OR%201=1", "")
+			So(code, ShouldEqual, 404)
+		})
+	})
+
+	Convey("Given an integer key that is not a number", t, func() {
+		c := CRUD{Model: func() (interface{}, interface{}) { return &city{}, nil }}
+		m, _ := c.Model()
+		db, _ := gorm.Open("sqlite3", tmp.Name())
+		defer db.Close()
+
+		Convey("Then it should not be found", func() {
+			_, err := c.whereKey(db, m, "abc")
+			So(err.(Fault).HTTPCode, ShouldEqual, 404)
+		})
+	})
+}
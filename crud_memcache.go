@@ -0,0 +1,199 @@
+package aqua
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// The memcache engine reads, sets (PUT) and deletes plain values by key. Conn
+// is host:port, or a comma separated list of them in which case keys are
+// spread over the servers by consistent hashing, so that adding or removing
+// a server moves only a small share of the keys. Values expire after the Ttl
+// of the CRUD field; without a Ttl they are kept until evicted.
+//
+// Each CRUD field keeps its own pool of connections, which is set up by
+// validate when the service is loaded.
+
+// points on the hash ring per server
+const memcacheReplicas = 100
+
+// memcache treats expirations beyond 30 days as unix timestamps
+const memcacheMaxRelTtl = 30 * 24 * time.Hour
+
+// memcacheAddr is resolved when dialled rather than at startup
+type memcacheAddr string
+
+func (a memcacheAddr) Network() string { return "tcp" }
+func (a memcacheAddr) String() string  { return string(a) }
+
+// hashRing is a memcache.ServerSelector which uses consistent hashing
+type hashRing struct {
+	points []uint32
+	addrs  map[uint32]net.Addr
+	all    []net.Addr
+}
+
+func newHashRing(servers []string) *hashRing {
+	h := &hashRing{
+		points: make([]uint32, 0, len(servers)*memcacheReplicas),
+		addrs:  make(map[uint32]net.Addr),
+		all:    make([]net.Addr, 0, len(servers)),
+	}
+	for _, s := range servers {
+		addr := memcacheAddr(s)
+		h.all = append(h.all, addr)
+		for i := 0; i < memcacheReplicas; i++ {
+			p := crc32.ChecksumIEEE([]byte(s + "#" + strconv.Itoa(i)))
+			if _, taken := h.addrs[p]; taken {
+				continue
+			}
+			h.addrs[p] = addr
+			h.points = append(h.points, p)
+		}
+	}
+	sort.Slice(h.points, func(i, j int) bool { return h.points[i] < h.points[j] })
+	return h
+}
+
+func (h *hashRing) PickServer(key string) (net.Addr, error) {
+	if len(h.points) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	p := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= p })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.addrs[h.points[i]], nil
+}
+
+func (h *hashRing) Each(fn func(net.Addr) error) error {
+	for _, a := range h.all {
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memcacheServers parses and validates the servers in Conn
+func memcacheServers(conn string) []string {
+	out := make([]string, 0)
+	for _, s := range strings.Split(conn, ",") {
+		s = strings.TrimSpace(s)
+		_, port, err := net.SplitHostPort(s)
+		if err != nil {
+			panic("Crud memcache conn must be host:port - " + s)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			panic("Crud memcache conn has an invalid port: " + s)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func (c *CRUD) validateMemcache() {
+	c.memc = memcache.NewFromSelector(newHashRing(memcacheServers(c.Conn)))
+	if c.Ttl != "" {
+		ttl, err := time.ParseDuration(c.Ttl)
+		if err != nil {
+			panic("Crud ttl is not a valid duration: " + c.Ttl)
+		}
+		if ttl < time.Second {
+			panic("Crud memcache ttl must be at least 1s: " + c.Ttl)
+		}
+		c.ttl = ttl
+	}
+}
+
+// expiration returns the expiry of an item as understood by memcache
+func (c *CRUD) expiration() int32 {
+	if c.ttl == 0 {
+		return 0
+	}
+	if c.ttl > memcacheMaxRelTtl {
+		return int32(time.Now().Add(c.ttl).Unix())
+	}
+	return int32(c.ttl / time.Second)
+}
+
+func memcacheFault(key string, err error) Fault {
+	if err == memcache.ErrCacheMiss {
+		return Fault{
+			HTTPCode: 404,
+			Message:  "Not found",
+			Issue:    fmt.Errorf("key %s not found", key),
+		}
+	}
+	if err == memcache.ErrMalformedKey {
+		return Fault{
+			HTTPCode: 400,
+			Message:  "Invalid key",
+			Issue:    err,
+		}
+	}
+	return Fault{
+		HTTPCode: 503,
+		Message:  "Storage unavailable",
+		Issue:    err,
+	}
+}
+
+func (c *CRUD) memcacheClient() (*memcache.Client, error) {
+	if c.memc == nil {
+		return nil, memcacheFault("", errors.New("memcache crud was not validated"))
+	}
+	return c.memc, nil
+}
+
+func (c *CRUD) Memcache_Read(primKey string) interface{} {
+	memc, err := c.memcacheClient()
+	if err != nil {
+		return err
+	}
+
+	it, err := memc.Get(primKey)
+	if err != nil {
+		return memcacheFault(primKey, err)
+	}
+	return string(it.Value)
+}
+
+func (c *CRUD) Memcache_Update(primKey string, j Aide) interface{} {
+	memc, err := c.memcacheClient()
+	if err != nil {
+		return err
+	}
+
+	j.LoadVars()
+	err = memc.Set(&memcache.Item{
+		Key:        primKey,
+		Value:      []byte(j.Body),
+		Expiration: c.expiration(),
+	})
+	if err != nil {
+		return memcacheFault(primKey, err)
+	}
+	return ""
+}
+
+func (c *CRUD) Memcache_Delete(primKey string, j Aide) interface{} {
+	memc, err := c.memcacheClient()
+	if err != nil {
+		return err
+	}
+
+	if err = memc.Delete(primKey); err != nil {
+		return memcacheFault(primKey, err)
+	}
+	return ""
+}
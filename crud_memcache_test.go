@@ -0,0 +1,229 @@
+package aqua
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeMemcache speaks enough of the memcache text protocol for get, set and delete
+type fakeMemcache struct {
+	sync.Mutex
+	ln    net.Listener
+	data  map[string][]byte
+	exp   map[string]string
+	dials int
+}
+
+func newFakeMemcache() *fakeMemcache {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	f := &fakeMemcache{ln: ln, data: make(map[string][]byte), exp: make(map[string]string)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.Lock()
+			f.dials++
+			f.Unlock()
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeMemcache) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeMemcache) serve(c net.Conn) {
+	defer c.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) < 2 {
+			return
+		}
+		f.Lock()
+		switch args[0] {
+		case "gets", "get":
+			for _, k := range args[1:] {
+				if v, ok := f.data[k]; ok {
+					fmt.Fprintf(rw, "VALUE %s 0 %d 1\r\n%s\r\n", k, len(v), v)
+				}
+			}
+			rw.WriteString("END\r\n")
+		case "set":
+			n, _ := strconv.Atoi(args[4])
+			v := make([]byte, n+2)
+			io.ReadFull(rw, v)
+			f.data[args[1]] = v[:n]
+			f.exp[args[1]] = args[3]
+			rw.WriteString("STORED\r\n")
+		case "delete":
+			if _, ok := f.data[args[1]]; ok {
+				delete(f.data, args[1])
+				rw.WriteString("DELETED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+		}
+		f.Unlock()
+		rw.Flush()
+	}
+}
+
+type cacheService struct {
+	RestService `root:"mc"`
+	sessions    CRUD `ttl:"10m"`
+	forever     CRUD
+	conn        string
+}
+
+func (s *cacheService) Sessions() CRUD {
+	return CRUD{Storage: cstr.Storage{Engine: "memcache", Conn: s.conn}}
+}
+
+func (s *cacheService) Forever() CRUD {
+	return CRUD{Storage: cstr.Storage{Engine: "memcache", Conn: s.conn}}
+}
+
+func TestCrudMemcache(t *testing.T) {
+
+	one, two := newFakeMemcache(), newFakeMemcache()
+	defer one.ln.Close()
+	defer two.ln.Close()
+
+	s := NewRestServer()
+	s.AddService(&cacheService{conn: one.addr() + "," + two.addr()})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	call := func(method, path, body string) (int, string) {
+		url := fmt.Sprintf("http://localhost:%d/mc%s", s.Port, path)
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	Convey("Given a memcache CRUD over two servers", t, func() {
+		Convey("Then values should be set, read and deleted", func() {
+			code, _ := call("PUT", "/sessions/s1", "hello")
+			So(code, ShouldEqual, 200)
+
+			code, body := call("GET", "/sessions/s1", "")
+			So(code, ShouldEqual, 200)
+			So(body, ShouldEqual, "hello")
+
+			code, _ = call("DELETE", "/sessions/s1", "")
+			So(code, ShouldEqual, 200)
+
+			code, _ = call("GET", "/sessions/s1", "")
+			So(code, ShouldEqual, 404)
+		})
+		Convey("Then deleting a missing key should return a 404", func() {
+			code, _ := call("DELETE", "/sessions/nope", "")
+			So(code, ShouldEqual, 404)
+		})
+		Convey("Then the ttl should be sent in seconds, and omitted without a ttl", func() {
+			call("PUT", "/sessions/s2", "x")
+			call("PUT", "/forever/f2", "y")
+			one.Lock()
+			two.Lock()
+			exp := map[string]string{}
+			for _, f := range []*fakeMemcache{one, two} {
+				for k, v := range f.exp {
+					exp[k] = v
+				}
+			}
+			two.Unlock()
+			one.Unlock()
+			So(exp["s2"], ShouldEqual, "600")
+			So(exp["f2"], ShouldEqual, "0")
+		})
+		Convey("Then keys should be spread over both servers", func() {
+			for i := 0; i < 40; i++ {
+				call("PUT", fmt.Sprintf("/forever/k%d", i), "v")
+			}
+			one.Lock()
+			two.Lock()
+			n1, n2 := len(one.data), len(two.data)
+			two.Unlock()
+			one.Unlock()
+			So(n1, ShouldBeGreaterThan, 0)
+			So(n2, ShouldBeGreaterThan, 0)
+		})
+		Convey("Then connections should be reused across requests", func() {
+			one.Lock()
+			dials := one.dials + two.dials
+			one.Unlock()
+			So(dials, ShouldBeLessThan, 10)
+		})
+	})
+}
+
+func TestMemcacheValidation(t *testing.T) {
+
+	Convey("Given memcache CRUD settings", t, func() {
+		Convey("Then malformed conns should be rejected at startup", func() {
+			for _, conn := range []string{"localhost", "localhost:port", "localhost:0", "a:11211,b"} {
+				c := CRUD{Storage: cstr.Storage{Engine: "memcache", Conn: conn}}
+				So(c.validate, ShouldPanic)
+			}
+		})
+		Convey("Then invalid ttls should be rejected at startup", func() {
+			for _, ttl := range []string{"soon", "500ms"} {
+				c := CRUD{Storage: cstr.Storage{Engine: "memcache", Conn: "localhost:11211"}}
+				c.Ttl = ttl
+				So(c.validate, ShouldPanic)
+			}
+		})
+		Convey("Then a valid setup should get a connection pool", func() {
+			c := CRUD{Storage: cstr.Storage{Engine: "memcache", Conn: "a:11211, b:11211"}}
+			c.Ttl = "1h"
+			So(c.validate, ShouldNotPanic)
+			So(c.memc, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a hash ring", t, func() {
+		servers := []string{"a:1", "b:1", "c:1"}
+		before := newHashRing(servers)
+		after := newHashRing(append(servers, "d:1"))
+
+		Convey("Then adding a server should move only a share of the keys", func() {
+			moved := 0
+			for i := 0; i < 1000; i++ {
+				k := "key" + strconv.Itoa(i)
+				a, _ := before.PickServer(k)
+				b, _ := after.PickServer(k)
+				if a.String() != b.String() {
+					moved++
+				}
+			}
+			So(moved, ShouldBeGreaterThan, 0)
+			So(moved, ShouldBeLessThan, 450)
+		})
+	})
+}
@@ -0,0 +1,811 @@
+package aqua
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mayur-tolexo/aero/refl"
+)
+
+// The memory engine keeps the models of a CRUD in memory, which is handy to
+// prototype an api or to test services without a database. Conn names the
+// store, so CRUD fields with the same Conn and Model share their data. Zero
+// integer keys are assigned the next value of a sequence and empty string
+// keys get a random UUID. The store can be seeded from a json file holding
+// an array of models (CRUD.Seed).
+//
+// Reads, creates, updates, deletes, listing and aggregates are supported;
+// ad-hoc sql (the /! and /$ routes, which are not set up) and soft delete
+// are not.
+
+type memTable struct {
+	sync.RWMutex
+	rows map[string]interface{}
+	keys []string // in order of creation
+	seq  int64
+
+	// held by updates from read to write, so that none of them is lost
+	update sync.Mutex
+}
+
+var memTables = struct {
+	sync.Mutex
+	byName map[string]*memTable
+}{byName: make(map[string]*memTable)}
+
+// memTableOf returns the table of a store and model, and whether it is new
+func memTableOf(conn string, m interface{}) (*memTable, bool) {
+	name := conn + "|" + refl.ObjSignature(m)
+
+	memTables.Lock()
+	defer memTables.Unlock()
+
+	if t, found := memTables.byName[name]; found {
+		return t, false
+	}
+	t := &memTable{rows: make(map[string]interface{}), keys: make([]string, 0)}
+	memTables.byName[name] = t
+	return t, true
+}
+
+func (c *CRUD) validateMemory(m interface{}) {
+	if c.SoftDelete {
+		panic("Crud soft delete is not supported by the memory engine")
+	}
+	if _, err := primaryField(m); err != nil {
+		panic(err.Error())
+	}
+	t, created := memTableOf(c.Conn, m)
+	if created && c.Seed != "" {
+		if err := t.seed(c.Seed, c.Model); err != nil {
+			panic(fmt.Sprintf("Crud seed %s could not be loaded: %s", c.Seed, err))
+		}
+	}
+}
+
+func (t *memTable) seed(file string, model func() (interface{}, interface{})) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	_, col := model()
+	if err = json.Unmarshal(b, col); err != nil {
+		return err
+	}
+	arr := reflect.ValueOf(col).Elem()
+	for i := 0; i < arr.Len(); i++ {
+		m := arr.Index(i)
+		if m.Kind() != reflect.Ptr {
+			m = m.Addr()
+		}
+		if _, err := t.insert(m.Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memCopy returns a deep copy of a model, so that callers never share the
+// instance kept in the table, or the slices, maps and pointers it holds
+func memCopy(m interface{}) interface{} {
+	return deepCopy(reflect.ValueOf(m), make(map[uintptr]reflect.Value)).Interface()
+}
+
+// deepCopy copies a value along with what it points to. Unexported fields
+// cannot be set, so they are copied as is.
+func deepCopy(v reflect.Value, seen map[uintptr]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		if c, found := seen[v.Pointer()]; found {
+			return c
+		}
+		out := reflect.New(v.Type().Elem())
+		seen[v.Pointer()] = out
+		out.Elem().Set(deepCopy(v.Elem(), seen))
+		return out
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if f := out.Field(i); f.CanSet() {
+				f.Set(deepCopy(v.Field(i), seen))
+			}
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(deepCopy(v.Index(i), seen))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(deepCopy(v.Index(i), seen))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			out.SetMapIndex(k, deepCopy(v.MapIndex(k), seen))
+		}
+		return out
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type()).Elem()
+		out.Set(deepCopy(v.Elem(), seen))
+		return out
+	}
+	return v
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// insert assigns a key to the model if it has none, and stores a copy of it
+func (t *memTable) insert(m interface{}) (string, error) {
+	pk, err := primaryField(m)
+	if err != nil {
+		return "", err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	// composite keys are never assigned
+	if keyVars(m) == nil {
+		switch pk.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if pk.Int() == 0 {
+				t.seq++
+				pk.SetInt(t.seq)
+			} else if pk.Int() > t.seq {
+				t.seq = pk.Int()
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if pk.Uint() == 0 {
+				t.seq++
+				pk.SetUint(uint64(t.seq))
+			} else if int64(pk.Uint()) > t.seq {
+				t.seq = int64(pk.Uint())
+			}
+		case reflect.String:
+			if pk.String() == "" {
+				pk.SetString(newUUID())
+			}
+		}
+	}
+
+	key := keyString(m)
+	if _, found := t.rows[key]; found {
+		return "", Fault{
+			HTTPCode: 409,
+			Message:  "Already exists",
+			Issue:    fmt.Errorf("key %s already exists", key),
+		}
+	}
+	t.rows[key] = memCopy(m)
+	t.keys = append(t.keys, key)
+	return key, nil
+}
+
+func (t *memTable) get(key string) (interface{}, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	m, found := t.rows[key]
+	if !found {
+		return nil, false
+	}
+	return memCopy(m), true
+}
+
+// put replaces a model that is in the table
+func (t *memTable) put(key string, m interface{}) bool {
+	t.Lock()
+	defer t.Unlock()
+	if _, found := t.rows[key]; !found {
+		return false
+	}
+	t.rows[key] = memCopy(m)
+	return true
+}
+
+func (t *memTable) remove(key string) bool {
+	t.Lock()
+	defer t.Unlock()
+	if _, found := t.rows[key]; !found {
+		return false
+	}
+	delete(t.rows, key)
+	for i, k := range t.keys {
+		if k == key {
+			t.keys = append(t.keys[:i], t.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// all returns copies of the models in order of creation
+func (t *memTable) all() []interface{} {
+	t.RLock()
+	defer t.RUnlock()
+	out := make([]interface{}, 0, len(t.keys))
+	for _, k := range t.keys {
+		out = append(out, memCopy(t.rows[k]))
+	}
+	return out
+}
+
+// inScope checks if a model belongs to the parent in the url
+func (c *CRUD) inScope(m interface{}, j Aide) bool {
+	if !c.nested() {
+		return true
+	}
+	f, _ := modelField(m, c.Parent.Column)
+	return fmt.Sprint(reflect.ValueOf(m).Elem().FieldByIndex(f.Index).Interface()) == c.parentKey(j)
+}
+
+// memQuery checks the params that the memory engine does not act upon itself
+func (c *CRUD) memQuery(m interface{}, j Aide) error {
+	if j.Request.URL.Query().Get("include") != "" {
+		return badParam("include is not supported by the memory engine")
+	}
+	if fields := requestedFields(j.Request); fields != nil {
+		// the fields themselves are picked when the response is written
+		if _, err := planOf(reflect.TypeOf(m)).columns(fields, principalOf(j.Request)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CRUD) Memory_Read(primKey string, j Aide) interface{} {
+	m, _ := c.Model()
+	if err := c.memQuery(m, j); err != nil {
+		return err
+	}
+
+	t, _ := memTableOf(c.Conn, m)
+	m, found := t.get(primKey)
+	if !found || !c.inScope(m, j) {
+		return keyNotFound(primKey)
+	}
+
+	h := c.newHook(j, m, nil)
+	h.Pkey = primKey
+	if err := c.hook("afterRead", h); err != nil {
+		return err
+	}
+	return m
+}
+
+func (c *CRUD) Memory_Create(j Aide) interface{} {
+	j.LoadVars()
+
+	m, _ := c.Model()
+	if err := json.Unmarshal([]byte(j.Body), m); err != nil {
+		return err
+	}
+	planOf(reflect.TypeOf(m)).scrub(m)
+	if err := c.adopt(m, j); err != nil {
+		return err
+	}
+
+	h := c.newHook(j, m, nil)
+	if err := c.hook("beforeCreate", h); err != nil {
+		return err
+	}
+
+	t, _ := memTableOf(c.Conn, m)
+	key, err := t.insert(m)
+	if err != nil {
+		return err
+	}
+	h.Pkey = key
+
+	if err := c.hook("afterCreate", h); err != nil {
+		t.remove(key)
+		return err
+	}
+	c.audit(j, "create", key, nil, auditValues(m))
+	return map[string]interface{}{"key": key, "rows_affected": 1, "success": 1}
+}
+
+func (c *CRUD) Memory_Update(primKey string, j Aide) interface{} {
+	j.LoadVars()
+
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(j.Body), &data); err != nil {
+		return err
+	}
+
+	m, _ := c.Model()
+	t, _ := memTableOf(c.Conn, m)
+
+	t.update.Lock()
+	defer t.update.Unlock()
+
+	m, found := t.get(primKey)
+	if !found || !c.inScope(m, j) {
+		return keyNotFound(primKey)
+	}
+
+	before := auditValues(m)
+	h := c.newHook(j, m, nil)
+	h.Pkey = primKey
+	h.Data = data
+	planOf(reflect.TypeOf(m)).scrubData(h.Data)
+	if err := c.hook("beforeUpdate", h); err != nil {
+		return err
+	}
+
+	// the key and the parent of a row cannot be changed
+	keep := []reflect.Value{}
+	for _, r := range planOf(reflect.TypeOf(m)).keys() {
+		if fv, ok := fieldByIndex(reflect.ValueOf(m), r.index); ok {
+			keep = append(keep, fv)
+		}
+	}
+	if c.nested() {
+		f, _ := modelField(m, c.Parent.Column)
+		keep = append(keep, reflect.ValueOf(m).Elem().FieldByIndex(f.Index))
+	}
+	kept := make([]reflect.Value, len(keep))
+	for i, v := range keep {
+		kept[i] = reflect.ValueOf(v.Interface())
+	}
+
+	if err := memOverlay(m, h.Data); err != nil {
+		return err
+	}
+	for i, v := range keep {
+		v.Set(kept[i])
+	}
+
+	if err := c.hook("afterUpdate", h); err != nil {
+		return err
+	}
+	if !t.put(primKey, m) {
+		// deleted meanwhile
+		return keyNotFound(primKey)
+	}
+	if c.Audit != nil {
+		before, after := auditChanges(before, auditValues(m))
+		c.audit(j, "update", primKey, before, after)
+	}
+
+	return map[string]interface{}{"success": 1}
+}
+
+// memOverlay sets the fields found in data (by json name, field name or
+// column) on a model
+func memOverlay(m interface{}, data map[string]interface{}) error {
+	p := planOf(reflect.TypeOf(m))
+	byName := make(map[string]interface{})
+	for k, v := range data {
+		for _, r := range p.fields {
+			if r.name == k || r.column == k {
+				byName[r.name] = v
+			}
+		}
+	}
+	b, err := json.Marshal(byName)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, m); err != nil {
+		return badParam(err.Error())
+	}
+	return nil
+}
+
+func (c *CRUD) Memory_Delete(primKey string, j Aide) interface{} {
+	m, _ := c.Model()
+	t, _ := memTableOf(c.Conn, m)
+
+	m, found := t.get(primKey)
+	if !found || !c.inScope(m, j) {
+		return keyNotFound(primKey)
+	}
+
+	h := c.newHook(j, m, nil)
+	h.Pkey = primKey
+	if err := c.hook("beforeDelete", h); err != nil {
+		return err
+	}
+	if !t.remove(primKey) {
+		return keyNotFound(primKey)
+	}
+	if err := c.hook("afterDelete", h); err != nil {
+		return err
+	}
+	c.audit(j, "delete", primKey, auditValues(m), nil)
+	return map[string]interface{}{"success": 1}
+}
+
+// memRows returns the models in scope which pass the filters of the request
+func (c *CRUD) memRows(m interface{}, j Aide) ([]interface{}, error) {
+	fs, err := c.filters(m, j.Request.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	t, _ := memTableOf(c.Conn, m)
+	p := planOf(reflect.TypeOf(m))
+
+	out := make([]interface{}, 0)
+	for _, row := range t.all() {
+		if !c.inScope(row, j) {
+			continue
+		}
+		ok := true
+		for _, f := range fs {
+			if ok, err = f.match(p.value(row, f.column)); err != nil {
+				return nil, err
+			} else if !ok {
+				break
+			}
+		}
+		if ok {
+			out = append(out, row)
+		}
+	}
+	return out, nil
+}
+
+func (c *CRUD) Memory_List(j Aide) interface{} {
+	m, col := c.Model()
+	q := j.Request.URL.Query()
+
+	if err := c.memQuery(m, j); err != nil {
+		return err
+	}
+	ord, err := c.order(m, q)
+	if err != nil {
+		return err
+	}
+	lim, off, err := page(q)
+	if err != nil {
+		return err
+	}
+	rows, err := c.memRows(m, j)
+	if err != nil {
+		return err
+	}
+
+	memSort(m, ord, rows)
+	rows = memPage(rows, lim, off)
+
+	out := reflect.ValueOf(col).Elem()
+	for _, row := range rows {
+		if out.Type().Elem().Kind() == reflect.Ptr {
+			out = reflect.Append(out, reflect.ValueOf(row))
+		} else {
+			out = reflect.Append(out, reflect.ValueOf(row).Elem())
+		}
+	}
+	reflect.ValueOf(col).Elem().Set(out)
+	return col
+}
+
+// memSort sorts models by an order clause (as returned by CRUD.order)
+func memSort(m interface{}, ord string, rows []interface{}) {
+	if ord == "" {
+		return
+	}
+	p := planOf(reflect.TypeOf(m))
+	sort.SliceStable(rows, func(a, b int) bool {
+		for _, o := range strings.Split(ord, ",") {
+			name, desc := o, false
+			if strings.HasSuffix(o, " desc") {
+				name, desc = strings.TrimSuffix(o, " desc"), true
+			}
+			cmp := compareValues(p.value(rows[a], name), p.value(rows[b], name))
+			if cmp != 0 {
+				return (cmp < 0) != desc
+			}
+		}
+		return false
+	})
+}
+
+func memPage(rows []interface{}, lim int, off int) []interface{} {
+	if off > len(rows) {
+		off = len(rows)
+	}
+	rows = rows[off:]
+	if len(rows) > lim {
+		rows = rows[:lim]
+	}
+	return rows
+}
+
+func (c *CRUD) Memory_Aggregate(j Aide) interface{} {
+	m, _ := c.Model()
+	q := j.Request.URL.Query()
+
+	aggs, err := c.aggregates(m, q)
+	if err != nil {
+		return err
+	}
+	grps, err := c.groups(m, q)
+	if err != nil {
+		return err
+	}
+	rows, err := c.memRows(m, j)
+	if err != nil {
+		return err
+	}
+	p := planOf(reflect.TypeOf(m))
+
+	// rows are grouped by the string form of the group columns
+	byGroup := make(map[string][]interface{})
+	keys := make([]string, 0)
+	if len(grps) == 0 {
+		keys = append(keys, "")
+		byGroup[""] = rows
+	} else {
+		for _, row := range rows {
+			vals := make([]string, len(grps))
+			for i, g := range grps {
+				vals[i] = memString(p.value(row, g))
+			}
+			k := strings.Join(vals, "\x00")
+			if _, found := byGroup[k]; !found {
+				keys = append(keys, k)
+			}
+			byGroup[k] = append(byGroup[k], row)
+		}
+		sort.Strings(keys)
+	}
+
+	out := make([]map[string]interface{}, 0)
+	for _, k := range keys {
+		group := byGroup[k]
+		res := make(map[string]interface{})
+		if len(grps) > 0 {
+			for i, v := range strings.Split(k, "\x00") {
+				res[grps[i]] = v
+			}
+		}
+		for _, a := range aggs {
+			res[a.alias] = a.compute(p, group)
+		}
+		out = append(out, res)
+	}
+	return out
+}
+
+// compute works out an aggregate over models. As in sql, aggregates other
+// than count are nil over no rows.
+func (a aggregate) compute(p *fieldPlan, rows []interface{}) interface{} {
+	if a.fn == "count" {
+		if a.column == "" {
+			return float64(len(rows))
+		}
+		n := 0
+		for _, row := range rows {
+			if v := p.value(row, a.column); v.IsValid() {
+				n++
+			}
+		}
+		return float64(n)
+	}
+
+	var sum float64
+	var res *float64
+	n := 0
+	for _, row := range rows {
+		f, ok := memFloat(p.value(row, a.column))
+		if !ok {
+			continue
+		}
+		n++
+		sum += f
+		switch {
+		case res == nil:
+			res = new(float64)
+			*res = f
+		case a.fn == "min" && f < *res:
+			*res = f
+		case a.fn == "max" && f > *res:
+			*res = f
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	switch a.fn {
+	case "sum":
+		return sum
+	case "avg":
+		return sum / float64(n)
+	}
+	return *res
+}
+
+// value returns the value of a column of a model, with pointers resolved. It
+// returns an invalid value for nil pointers (null).
+func (p *fieldPlan) value(m interface{}, column string) reflect.Value {
+	for _, r := range p.fields {
+		if r.column == column {
+			v, ok := fieldByIndex(reflect.ValueOf(m), r.index)
+			if !ok {
+				return reflect.Value{}
+			}
+			for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+				if v.IsNil() {
+					return reflect.Value{}
+				}
+				v = v.Elem()
+			}
+			return v
+		}
+	}
+	return reflect.Value{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// match checks a column value against the filter
+func (f filter) match(v reflect.Value) (bool, error) {
+	switch f.op {
+	case "null":
+		isNull := !v.IsValid()
+		if f.values[0] == "false" || f.values[0] == "0" {
+			return !isNull, nil
+		}
+		return isNull, nil
+	case "like":
+		if !v.IsValid() {
+			return false, nil
+		}
+		pat := regexp.QuoteMeta(f.values[0])
+		pat = strings.Replace(pat, "%", ".*", -1)
+		pat = strings.Replace(pat, "_", ".", -1)
+		return regexp.MustCompile("^" + pat + "$").MatchString(memString(v)), nil
+	}
+
+	if !v.IsValid() {
+		// comparisons with null are never true
+		return false, nil
+	}
+	for _, s := range f.values {
+		w, err := parseAs(v.Type(), s)
+		if err != nil {
+			return false, badParam(fmt.Sprintf("Invalid value %s for %s", s, f.column))
+		}
+		cmp := compareValues(v, w)
+		var ok bool
+		switch f.op {
+		case "eq", "in":
+			ok = cmp == 0
+		case "ne":
+			ok = cmp != 0
+		case "gt":
+			ok = cmp > 0
+		case "gte":
+			ok = cmp >= 0
+		case "lt":
+			ok = cmp < 0
+		case "lte":
+			ok = cmp <= 0
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseAs converts a query string value to the type of a column
+func parseAs(t reflect.Type, s string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	switch {
+	case t == timeType:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"} {
+			if tm, err := time.Parse(layout, s); err == nil {
+				v.Set(reflect.ValueOf(tm))
+				return v, nil
+			}
+		}
+		return v, fmt.Errorf("invalid time %s", s)
+	case t.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		v.SetBool(b)
+		return v, err
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		v.SetFloat(f)
+		return v, err
+	}
+	return v, setFromString(v, s)
+}
+
+// compareValues compares two values of the same type; nulls come first
+func compareValues(a, b reflect.Value) int {
+	switch {
+	case !a.IsValid() && !b.IsValid():
+		return 0
+	case !a.IsValid():
+		return -1
+	case !b.IsValid():
+		return 1
+	}
+	if a.Type() == timeType {
+		ta, tb := a.Interface().(time.Time), b.Interface().(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	}
+	if fa, ok := memFloat(a); ok {
+		fb, _ := memFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(memString(a), memString(b))
+}
+
+func memFloat(v reflect.Value) (float64, bool) {
+	if !v.IsValid() {
+		return 0, false
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Bool:
+		if v.Bool() {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func memString(v reflect.Value) string {
+	if !v.IsValid() {
+		return ""
+	}
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,215 @@
+package aqua
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type book struct {
+	Id     int     `json:"id"`
+	Title  string  `json:"title"`
+	Genre  string  `json:"genre"`
+	Price  float64 `json:"price"`
+	Secret string  `json:"secret" aqua:"hidden"`
+}
+
+// CrudBeforeUpdate gives concurrent updates a chance to overlap
+func (b *book) CrudBeforeUpdate(h *Hook) error {
+	time.Sleep(20 * time.Millisecond)
+	return nil
+}
+
+type tag struct {
+	Code string `json:"code" gorm:"primary_key"`
+	Name string `json:"name"`
+}
+
+type memoryService struct {
+	RestService `root:"mem"`
+	books       CRUD
+	tags        CRUD
+	seed        string
+}
+
+func (s *memoryService) Books() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "memory", Conn: "memory-test"},
+		Model: func() (interface{}, interface{}) {
+			return &book{}, &[]book{}
+		},
+		Columns: []string{"title", "genre", "price"},
+		Seed:    s.seed,
+	}
+}
+
+func (s *memoryService) Tags() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "memory", Conn: "memory-test"},
+		Model: func() (interface{}, interface{}) {
+			return &tag{}, &[]tag{}
+		},
+	}
+}
+
+func TestCrudMemory(t *testing.T) {
+
+	f, _ := ioutil.TempFile("", "books")
+	f.WriteString(`[{"id":1,"title":"Dune","genre":"scifi","price":10},
+		{"id":2,"title":"Emma","genre":"classic","price":5},
+		{"id":3,"title":"Solaris","genre":"scifi","price":20}]`)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	s := NewRestServer()
+	s.AddService(&memoryService{seed: f.Name()})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	call := func(method, path, body string) (int, string) {
+		url := fmt.Sprintf("http://localhost:%d/mem%s", s.Port, path)
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	titles := func(body string) []string {
+		var out []book
+		json.Unmarshal([]byte(body), &out)
+		ts := make([]string, len(out))
+		for i, b := range out {
+			ts[i] = b.Title
+		}
+		return ts
+	}
+
+	Convey("Given a memory CRUD seeded from a file", t, func() {
+		Convey("Then seeded models should be read by key", func() {
+			code, body := call("GET", "/books/2", "")
+			So(code, ShouldEqual, 200)
+			So(body, ShouldContainSubstring, `"title":"Emma"`)
+
+			code, _ = call("GET", "/books/99", "")
+			So(code, ShouldEqual, 404)
+		})
+		Convey("Then created models should get the next key", func() {
+			code, body := call("POST", "/books", `{"title":"Ubik","genre":"scifi","price":7,"secret":"x"}`)
+			So(code, ShouldEqual, 200)
+			So(body, ShouldContainSubstring, `"key":"4"`)
+
+			code, body = call("GET", "/books/4", "")
+			So(code, ShouldEqual, 200)
+			So(body, ShouldContainSubstring, `"title":"Ubik"`)
+			So(body, ShouldNotContainSubstring, `"secret"`)
+		})
+		Convey("Then updates should change only the given fields", func() {
+			code, _ := call("PUT", "/books/1", `{"price":12,"id":50}`)
+			So(code, ShouldEqual, 200)
+			_, body := call("GET", "/books/1", "")
+			So(body, ShouldContainSubstring, `"price":12`)
+			So(body, ShouldContainSubstring, `"title":"Dune"`)
+			So(body, ShouldContainSubstring, `"id":1`)
+		})
+		Convey("Then concurrent updates should not be lost", func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() { defer wg.Done(); call("PUT", "/books/2", `{"title":"Persuasion"}`) }()
+			go func() { defer wg.Done(); call("PUT", "/books/2", `{"genre":"romance"}`) }()
+			wg.Wait()
+			_, body := call("GET", "/books/2", "")
+			So(body, ShouldContainSubstring, `"title":"Persuasion"`)
+			So(body, ShouldContainSubstring, `"genre":"romance"`)
+			call("PUT", "/books/2", `{"title":"Emma","genre":"classic"}`)
+		})
+		Convey("Then lists should be filtered, ordered and paged", func() {
+			code, body := call("GET", "/books?genre=scifi&order=-price", "")
+			So(code, ShouldEqual, 200)
+			So(titles(body), ShouldResemble, []string{"Solaris", "Dune", "Ubik"})
+
+			_, body = call("GET", "/books?price.lt=10&order=title", "")
+			So(titles(body), ShouldResemble, []string{"Emma", "Ubik"})
+
+			_, body = call("GET", "/books?title.like=%25a%25&order=title&limit=1&offset=1", "")
+			So(titles(body), ShouldResemble, []string{"Solaris"})
+
+			code, _ = call("GET", "/books?foo=bar", "")
+			So(code, ShouldEqual, 200)
+			code, _ = call("GET", "/books?id=1", "")
+			So(code, ShouldEqual, 400)
+		})
+		Convey("Then aggregates should be computed per group", func() {
+			code, body := call("GET", "/books/aggregate?agg=count,sum(price)&by=genre", "")
+			So(code, ShouldEqual, 200)
+			var rows []map[string]interface{}
+			json.Unmarshal([]byte(body), &rows)
+			So(len(rows), ShouldEqual, 2)
+			So(rows[1]["genre"], ShouldEqual, "scifi")
+			So(rows[1]["count"], ShouldEqual, 3)
+			So(rows[1]["sum_price"], ShouldEqual, 39)
+		})
+		Convey("Then deleted models should be gone", func() {
+			code, _ := call("DELETE", "/books/4", "")
+			So(code, ShouldEqual, 200)
+			code, _ = call("GET", "/books/4", "")
+			So(code, ShouldEqual, 404)
+			code, _ = call("DELETE", "/books/4", "")
+			So(code, ShouldEqual, 404)
+		})
+	})
+
+	Convey("Given a memory CRUD with string keys", t, func() {
+		Convey("Then empty keys should get a uuid", func() {
+			code, body := call("POST", "/tags", `{"name":"new"}`)
+			So(code, ShouldEqual, 200)
+			var out map[string]interface{}
+			json.Unmarshal([]byte(body), &out)
+			So(len(out["key"].(string)), ShouldEqual, 36)
+		})
+		Convey("Then existing keys should be rejected", func() {
+			call("POST", "/tags", `{"code":"go","name":"Go"}`)
+			code, _ := call("POST", "/tags", `{"code":"go","name":"Golang"}`)
+			So(code, ShouldEqual, 409)
+		})
+	})
+
+	Convey("Given a model holding slices, maps and pointers", t, func() {
+		type shelf struct {
+			Books []string
+			Count map[string]int
+			Top   *book
+		}
+		m := &shelf{Books: []string{"a"}, Count: map[string]int{"a": 1}, Top: &book{Title: "a"}}
+
+		Convey("Then copies should not share them", func() {
+			c := memCopy(m).(*shelf)
+			c.Books[0], c.Count["a"], c.Top.Title = "b", 2, "b"
+			So(m.Books[0], ShouldEqual, "a")
+			So(m.Count["a"], ShouldEqual, 1)
+			So(m.Top.Title, ShouldEqual, "a")
+		})
+	})
+
+	Convey("Given a memory CRUD with soft delete", t, func() {
+		c := CRUD{
+			Storage:    cstr.Storage{Engine: "memory", Conn: "memory-test"},
+			Model:      func() (interface{}, interface{}) { return &note{}, &[]note{} },
+			SoftDelete: true,
+		}
+		Convey("Then it should be rejected at startup", func() {
+			So(c.validate, ShouldPanic)
+		})
+	})
+}
@@ -0,0 +1,153 @@
+package aqua
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/str"
+)
+
+// Parent nests a CRUD resource under a parent resource. The generated routes
+// become /<Url>/{<Var>}/<crud url>/{pkey} and every read and write is scoped
+// to the rows whose Column (the foreign key in the model) matches the parent
+// key found in the url.
+type Parent struct {
+	Url    string
+	Var    string
+	Column string
+}
+
+func (c *CRUD) nested() bool {
+	return c.Parent.Url != ""
+}
+
+func (c *CRUD) validateParent(m interface{}) {
+	if !c.nested() {
+		return
+	}
+	if c.Parent.Var == "" {
+		c.Parent.Var = "parent"
+	}
+	if c.Parent.Var == "pkey" {
+		panic("Crud parent var cannot be named pkey")
+	}
+	if c.Parent.Column == "" {
+		panic("Crud parent column not specified")
+	}
+	if _, ok := modelField(m, c.Parent.Column); !ok {
+		panic(fmt.Sprintf("Crud parent column %s not found in model", c.Parent.Column))
+	}
+}
+
+// parentRoot returns the root under which the nested resource is served. The
+// parent is added to the root (and not to the url) so that the parent key is
+// not passed as an input to the crud methods.
+func (c *CRUD) parentRoot(root string) string {
+	if !c.nested() {
+		return root
+	}
+	return cleanUrl(root, c.Parent.Url, "{"+c.Parent.Var+"}")
+}
+
+func (c *CRUD) parentKey(j Aide) string {
+	return mux.Vars(j.Request)[c.Parent.Var]
+}
+
+// scope restricts the query to the rows of the parent in the url
+func (c *CRUD) scope(db *gorm.DB, j Aide) *gorm.DB {
+	if !c.nested() {
+		return db
+	}
+	return db.Where(fmt.Sprintf("%s = ?", gorm.ToDBName(c.Parent.Column)), c.parentKey(j))
+}
+
+// adopt sets the foreign key of a new model to the parent in the url
+func (c *CRUD) adopt(m interface{}, j Aide) error {
+	if !c.nested() {
+		return nil
+	}
+	f, _ := modelField(m, c.Parent.Column)
+	return setFromString(reflect.ValueOf(m).Elem().FieldByIndex(f.Index), c.parentKey(j))
+}
+
+// preload adds the associations requested via ?include=a,b to the query.
+// Only the associations listed in CRUD.Include can be requested.
+func (c *CRUD) preload(db *gorm.DB, j Aide) (*gorm.DB, error) {
+	inc := j.Request.URL.Query().Get("include")
+	if inc == "" {
+		return db, nil
+	}
+	for _, name := range strings.Split(inc, ",") {
+		name = strings.TrimSpace(name)
+		assoc := ""
+		for _, allowed := range c.Include {
+			if strings.EqualFold(allowed, name) || str.UrlCase(allowed) == name {
+				assoc = allowed
+				break
+			}
+		}
+		if assoc == "" {
+			return nil, Fault{
+				HTTPCode: 400,
+				Message:  "Cannot include " + name,
+				Issue:    errors.New("include not allowed: " + name),
+			}
+		}
+		db = db.Preload(assoc)
+	}
+	return db, nil
+}
+
+// modelField finds the struct field of a model by its name or column name
+func modelField(m interface{}, name string) (reflect.StructField, bool) {
+	t := reflect.TypeOf(m)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Name == name || gorm.ToDBName(f.Name) == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// primaryField returns the primary key field of a model
+func primaryField(m interface{}) (reflect.Value, error) {
+	for _, r := range planOf(reflect.TypeOf(m)).fields {
+		if r.primary {
+			if fv, ok := fieldByIndex(reflect.ValueOf(m), r.index); ok {
+				return fv, nil
+			}
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("Model %T has no primary key", m)
+}
+
+func setFromString(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(i)
+	default:
+		return fmt.Errorf("Cannot set %s from a string", v.Type())
+	}
+	return nil
+}
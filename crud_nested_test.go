@@ -0,0 +1,99 @@
+package aqua
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type order struct {
+	Id         int
+	CustomerId int
+	Amount     float64
+}
+
+type nestedService struct {
+	RestService `root:"-"`
+	orders      CRUD
+}
+
+func (s *nestedService) Orders() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "mysql", Conn: "blah"},
+		Model: func() (interface{}, interface{}) {
+			return &order{}, &[]order{}
+		},
+		Parent: Parent{Url: "customers", Var: "cid", Column: "customer_id"},
+	}
+}
+
+type badParentService struct {
+	RestService
+	orders CRUD
+}
+
+func (s *badParentService) Orders() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "mysql", Conn: "blah"},
+		Model: func() (interface{}, interface{}) {
+			return &order{}, nil
+		},
+		Parent: Parent{Url: "customers", Column: "client_id"},
+	}
+}
+
+func TestNestedCrudRoutes(t *testing.T) {
+
+	Convey("Given a CRUD nested under a parent resource", t, func() {
+		s := NewRestServer()
+		s.AddService(&nestedService{})
+		s.loadAllEndpoints()
+
+		Convey("Then the routes should contain the parent key", func() {
+			for _, id := range []string{
+				"GET:/customers/{cid}/orders/{pkey}",
+				"PUT:/customers/{cid}/orders/{pkey}",
+				"DELETE:/customers/{cid}/orders/{pkey}",
+				"POST:/customers/{cid}/orders",
+				"POST:/customers/{cid}/orders/$",
+			} {
+				_, found := s.apis[id]
+				So(found, ShouldBeTrue)
+			}
+		})
+	})
+
+	Convey("Given a CRUD parent whose column is missing in the model", t, func() {
+		Convey("Then loading the endpoints should panic", func() {
+			s := NewRestServer()
+			s.AddService(&badParentService{})
+			So(s.loadAllEndpoints, ShouldPanic)
+		})
+	})
+
+	Convey("Given a nested CRUD and a request for a parent", t, func() {
+		c := CRUD{Parent: Parent{Url: "customers", Var: "cid", Column: "customer_id"}}
+		r, _ := http.NewRequest("POST", "/customers/42/orders", nil)
+		r = mux.SetURLVars(r, map[string]string{"cid": "42"})
+
+		Convey("Then a new model should be adopted by the parent", func() {
+			o := &order{}
+			So(c.adopt(o, NewAide(nil, r)), ShouldBeNil)
+			So(o.CustomerId, ShouldEqual, 42)
+		})
+	})
+
+	Convey("Given a CRUD with includable associations", t, func() {
+		c := CRUD{Include: []string{"Orders"}}
+
+		Convey("Then associations that are not listed should be rejected", func() {
+			r, _ := http.NewRequest("GET", "/customers/1?include=secrets", nil)
+			_, err := c.preload(nil, NewAide(nil, r))
+			So(err, ShouldNotBeNil)
+			So(err.(Fault).HTTPCode, ShouldEqual, 400)
+		})
+	})
+}
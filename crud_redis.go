@@ -0,0 +1,396 @@
+package aqua
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// The redis engine stores values by key, under an optional Namespace (as in
+// namespace:key). Without a Model, values are plain strings that are set by
+// PUT and read by GET, much like memcache. With a Model, each value is a
+// hash whose fields map to the struct fields of the model (use the redis tag
+// to rename them); models are created by POST, partially updated by PUT and
+// can be listed by a key pattern (GET ?match=user*). Values expire after the
+// Ttl of the CRUD field, if set.
+//
+// Conn is either host:port, host:port/db or a redis:// url
+
+var redisPools = struct {
+	sync.Mutex
+	byConn map[string]*redis.Pool
+}{byConn: make(map[string]*redis.Pool)}
+
+// redisPool returns the shared connection pool of a redis server
+func redisPool(conn string) *redis.Pool {
+	redisPools.Lock()
+	defer redisPools.Unlock()
+
+	if p, found := redisPools.byConn[conn]; found {
+		return p
+	}
+	p := &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return dialRedis(conn)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	redisPools.byConn[conn] = p
+	return p
+}
+
+func dialRedis(conn string) (redis.Conn, error) {
+	if strings.HasPrefix(conn, "redis://") {
+		return redis.DialURL(conn)
+	}
+	addr, db := conn, 0
+	if slash := strings.Index(conn, "/"); slash > 0 {
+		addr = conn[:slash]
+		db, _ = strconv.Atoi(conn[slash+1:])
+	}
+	return redis.Dial("tcp", addr, redis.DialDatabase(db))
+}
+
+func validateRedisConn(conn string) {
+	if strings.HasPrefix(conn, "redis://") {
+		return
+	}
+	addr := conn
+	if slash := strings.Index(conn, "/"); slash > 0 {
+		addr = conn[:slash]
+		if _, err := strconv.Atoi(conn[slash+1:]); err != nil {
+			panic("Crud redis conn has an invalid db: " + conn)
+		}
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil {
+		panic("Crud redis conn must be host:port - " + conn)
+	} else if _, err := strconv.Atoi(port); err != nil {
+		panic("Crud redis conn has an invalid port: " + conn)
+	}
+}
+
+func (c *CRUD) redisKey(key string) string {
+	if c.Namespace == "" {
+		return key
+	}
+	return c.Namespace + ":" + key
+}
+
+// redisExpire adds the expiry of a key to a MULTI block
+func (c *CRUD) redisExpire(rc redis.Conn, key string) {
+	if c.ttl > 0 {
+		rc.Send("PEXPIRE", key, int64(c.ttl/time.Millisecond))
+	}
+}
+
+// keyNotFound is returned by the key value engines for missing keys
+func keyNotFound(key string) Fault {
+	return Fault{
+		HTTPCode: 404,
+		Message:  "Not found",
+		Issue:    fmt.Errorf("key %s not found", key),
+	}
+}
+
+func (c *CRUD) Redis_Read(primKey string, j Aide) interface{} {
+	rc := redisPool(c.Conn).Get()
+	defer rc.Close()
+
+	key := c.redisKey(primKey)
+
+	if c.Model == nil {
+		data, err := redis.String(rc.Do("GET", key))
+		if err == redis.ErrNil {
+			return keyNotFound(key)
+		} else if err != nil {
+			return err
+		}
+		return data
+	}
+
+	vals, err := redis.Values(rc.Do("HGETALL", key))
+	if err != nil {
+		return err
+	}
+	if len(vals) == 0 {
+		return keyNotFound(key)
+	}
+	m, _ := c.Model()
+	if err := redis.ScanStruct(vals, m); err != nil {
+		return err
+	}
+
+	h := c.newHook(j, m, nil)
+	h.Pkey = primKey
+	if err := c.hook("afterRead", h); err != nil {
+		return err
+	}
+	return m
+}
+
+func (c *CRUD) Redis_Create(j Aide) interface{} {
+	j.LoadVars()
+
+	m, _ := c.Model()
+	if err := json.Unmarshal([]byte(j.Body), m); err != nil {
+		return err
+	}
+	planOf(reflect.TypeOf(m)).scrub(m)
+
+	rc := redisPool(c.Conn).Get()
+	defer rc.Close()
+
+	// a zero integer key is assigned the next value of a sequence
+	pk, err := primaryField(m)
+	if err != nil {
+		return err
+	}
+	switch pk.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if pk.Int() == 0 {
+			seq, err := redis.Int64(rc.Do("INCR", c.redisKey("_seq")))
+			if err != nil {
+				return err
+			}
+			pk.SetInt(seq)
+		}
+	case reflect.String:
+		if pk.String() == "" {
+			return badParam("Primary key is missing")
+		}
+	}
+	primKey := fmt.Sprint(pk.Interface())
+	key := c.redisKey(primKey)
+
+	h := c.newHook(j, m, nil)
+	h.Pkey = primKey
+	if err := c.hook("beforeCreate", h); err != nil {
+		return err
+	}
+
+	// WATCH makes sure that the key is not created by someone else meanwhile
+	if _, err := rc.Do("WATCH", key); err != nil {
+		return err
+	}
+	exists, err := redis.Bool(rc.Do("EXISTS", key))
+	if err != nil {
+		return err
+	}
+	if exists {
+		rc.Do("UNWATCH")
+		return Fault{
+			HTTPCode: 409,
+			Message:  "Already exists",
+			Issue:    fmt.Errorf("key %s already exists", key),
+		}
+	}
+	rc.Send("MULTI")
+	rc.Send("HMSET", redis.Args{}.Add(key).AddFlat(m)...)
+	c.redisExpire(rc, key)
+	reply, err := rc.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return Fault{
+			HTTPCode: 409,
+			Message:  "Already exists",
+			Issue:    fmt.Errorf("key %s was created concurrently", key),
+		}
+	}
+
+	if err := c.hook("afterCreate", h); err != nil {
+		return err
+	}
+	return map[string]interface{}{"key": primKey, "success": 1}
+}
+
+func (c *CRUD) Redis_Update(primKey string, j Aide) interface{} {
+	j.LoadVars()
+
+	rc := redisPool(c.Conn).Get()
+	defer rc.Close()
+
+	key := c.redisKey(primKey)
+
+	if c.Model == nil {
+		args := redis.Args{}.Add(key, j.Body)
+		if c.ttl > 0 {
+			args = args.Add("PX", int64(c.ttl/time.Millisecond))
+		}
+		if _, err := rc.Do("SET", args...); err != nil {
+			return err
+		}
+		return map[string]interface{}{"success": 1}
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(j.Body), &data); err != nil {
+		return err
+	}
+
+	if _, err := rc.Do("WATCH", key); err != nil {
+		return err
+	}
+	vals, err := redis.Values(rc.Do("HGETALL", key))
+	if err != nil {
+		return err
+	}
+	if len(vals) == 0 {
+		rc.Do("UNWATCH")
+		return keyNotFound(key)
+	}
+	m, _ := c.Model()
+	if err := redis.ScanStruct(vals, m); err != nil {
+		return err
+	}
+
+	h := c.newHook(j, m, nil)
+	h.Pkey = primKey
+	h.Data = data
+	planOf(reflect.TypeOf(m)).scrubData(h.Data)
+	if err := c.hook("beforeUpdate", h); err != nil {
+		rc.Do("UNWATCH")
+		return err
+	}
+
+	// overlay the changes on the stored model, but keep its key
+	b, _ := json.Marshal(h.Data)
+	if err := json.Unmarshal(b, m); err != nil {
+		rc.Do("UNWATCH")
+		return err
+	}
+	if pk, err := primaryField(m); err == nil {
+		setFromString(pk, primKey)
+	}
+
+	rc.Send("MULTI")
+	rc.Send("HMSET", redis.Args{}.Add(key).AddFlat(m)...)
+	c.redisExpire(rc, key)
+	reply, err := rc.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return Fault{
+			HTTPCode: 409,
+			Message:  "Modified concurrently, please retry",
+			Issue:    fmt.Errorf("key %s was modified concurrently", key),
+		}
+	}
+
+	if err := c.hook("afterUpdate", h); err != nil {
+		return err
+	}
+	return map[string]interface{}{"success": 1}
+}
+
+func (c *CRUD) Redis_Delete(primKey string, j Aide) interface{} {
+	rc := redisPool(c.Conn).Get()
+	defer rc.Close()
+
+	key := c.redisKey(primKey)
+
+	var m interface{}
+	if c.Model != nil {
+		m, _ = c.Model()
+		h := c.newHook(j, m, nil)
+		h.Pkey = primKey
+		if c.hasHook(m, "beforeDelete") {
+			vals, err := redis.Values(rc.Do("HGETALL", key))
+			if err != nil {
+				return err
+			}
+			redis.ScanStruct(vals, m)
+		}
+		if err := c.hook("beforeDelete", h); err != nil {
+			return err
+		}
+	}
+
+	n, err := redis.Int(rc.Do("DEL", key))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return keyNotFound(key)
+	}
+
+	if m != nil {
+		h := c.newHook(j, m, nil)
+		h.Pkey = primKey
+		if err := c.hook("afterDelete", h); err != nil {
+			return err
+		}
+	}
+	return map[string]interface{}{"success": 1}
+}
+
+// Redis_List returns the models whose keys match ?match (default *), up to ?limit
+func (c *CRUD) Redis_List(j Aide) interface{} {
+	q := j.Request.URL.Query()
+	lim, _, err := page(q)
+	if err != nil {
+		return err
+	}
+	match := q.Get("match")
+	if match == "" {
+		match = "*"
+	}
+	seq := c.redisKey("_seq")
+
+	rc := redisPool(c.Conn).Get()
+	defer rc.Close()
+
+	_, col := c.Model()
+	out := reflect.ValueOf(col).Elem()
+	cursor := "0"
+	for {
+		res, err := redis.Values(rc.Do("SCAN", cursor, "MATCH", c.redisKey(match), "COUNT", lim))
+		if err != nil {
+			return err
+		}
+		cursor, _ = redis.String(res[0], nil)
+		keys, _ := redis.Strings(res[1], nil)
+
+		for _, key := range keys {
+			if key == seq || out.Len() >= lim {
+				continue
+			}
+			vals, err := redis.Values(rc.Do("HGETALL", key))
+			if err != nil {
+				// not a hash
+				continue
+			}
+			m, _ := c.Model()
+			if len(vals) == 0 || redis.ScanStruct(vals, m) != nil {
+				continue
+			}
+			if out.Type().Elem().Kind() == reflect.Ptr {
+				out = reflect.Append(out, reflect.ValueOf(m))
+			} else {
+				out = reflect.Append(out, reflect.ValueOf(m).Elem())
+			}
+		}
+		if cursor == "0" || out.Len() >= lim {
+			break
+		}
+	}
+	reflect.ValueOf(col).Elem().Set(out)
+	return col
+}
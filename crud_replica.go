@@ -0,0 +1,163 @@
+package aqua
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/db/orm"
+)
+
+// Reads (Rdbms_Read, listing, aggregates and the sql endpoints) are sent to
+// the Replicas of a CRUD in turn, while writes always go to the primary
+// Conn. A replica that cannot be reached is skipped for a while, and if none
+// is available reads fall back to the primary.
+//
+// With ReadYourWrites, a client that writes is handed a cookie that keeps its
+// reads on the primary for the given duration, so that it does not miss its
+// own changes while the replicas catch up.
+
+// how often a replica in use is pinged, and how long a failed one is skipped
+var replicaCheckEvery = 5 * time.Second
+var replicaRetryAfter = 10 * time.Second
+
+const pinCookie = "aqua-primary-until"
+
+type replica struct {
+	conn      string
+	checkedAt time.Time
+	downUntil time.Time
+}
+
+type replicaSet struct {
+	sync.Mutex
+	engine   string
+	replicas []*replica
+	next     uint32
+}
+
+func newReplicaSet(engine string, conns []string) *replicaSet {
+	rs := &replicaSet{engine: engine, replicas: make([]*replica, 0, len(conns))}
+	for _, c := range conns {
+		rs.replicas = append(rs.replicas, &replica{conn: c})
+	}
+	return rs
+}
+
+// pick returns the next healthy replica, or nil if there is none
+func (rs *replicaSet) pick() *gorm.DB {
+	n := len(rs.replicas)
+	start := int(atomic.AddUint32(&rs.next, 1) - 1)
+	for i := 0; i < n; i++ {
+		r := rs.replicas[(start+i)%n]
+		if dbo := rs.open(r); dbo != nil {
+			return dbo
+		}
+	}
+	return nil
+}
+
+// open connects to a replica, unless it is known to be down, and pings it
+// every so often
+func (rs *replicaSet) open(r *replica) (dbo *gorm.DB) {
+	now := time.Now()
+
+	rs.Lock()
+	if now.Before(r.downUntil) {
+		rs.Unlock()
+		return nil
+	}
+	check := now.Sub(r.checkedAt) >= replicaCheckEvery
+	if check {
+		r.checkedAt = now
+	}
+	rs.Unlock()
+
+	defer func() {
+		if e := recover(); e != nil {
+			rs.down(r)
+			dbo = nil
+		}
+	}()
+	dbo = orm.GetConn(rs.engine, r.conn)
+	if dbo == nil || dbo.Error != nil {
+		rs.down(r)
+		return nil
+	}
+	if check {
+		if err := dbo.DB().Ping(); err != nil {
+			rs.down(r)
+			return nil
+		}
+	}
+	return dbo
+}
+
+func (rs *replicaSet) down(r *replica) {
+	rs.Lock()
+	defer rs.Unlock()
+	r.downUntil = time.Now().Add(replicaRetryAfter)
+	r.checkedAt = time.Time{}
+}
+
+func (c *CRUD) validateReplicas() {
+	if len(c.Replicas) == 0 {
+		if c.ReadYourWrites > 0 {
+			panic("Crud ReadYourWrites needs Replicas")
+		}
+		return
+	}
+	if c.getMethod("create") != "Rdbms_Create" {
+		panic("Crud replicas are supported for RDBMS engines only")
+	}
+	for _, r := range c.Replicas {
+		if r == "" {
+			panic("Crud replica conn not specified")
+		}
+	}
+	c.replicas = newReplicaSet(c.Engine, c.Replicas)
+}
+
+// readConn returns the connection to read from: a replica, unless the client
+// is pinned to the primary or no replica is available
+func (c *CRUD) readConn(j Aide) *gorm.DB {
+	if c.replicas != nil && !c.pinned(j.Request) {
+		if dbo := c.replicas.pick(); dbo != nil {
+			return dbo
+		}
+	}
+	return orm.GetConn(c.Engine, c.Conn)
+}
+
+func (c *CRUD) pinned(r *http.Request) bool {
+	if c.ReadYourWrites <= 0 || r == nil {
+		return false
+	}
+	ck, err := r.Cookie(pinCookie)
+	if err != nil {
+		return false
+	}
+	// the client holds the cookie, so a pin longer than any we hand out is
+	// not honoured
+	until, err := strconv.ParseInt(ck.Value, 10, 64)
+	now := time.Now()
+	return err == nil && now.UnixNano() < until && until <= now.Add(c.ReadYourWrites).UnixNano()
+}
+
+// pin keeps the reads of the client on the primary for a while after a write
+func (c *CRUD) pin(j Aide) {
+	if c.replicas == nil || c.ReadYourWrites <= 0 || j.Response == nil {
+		return
+	}
+	http.SetCookie(j.Response, &http.Cookie{
+		Name:     pinCookie,
+		Value:    fmt.Sprint(time.Now().Add(c.ReadYourWrites).UnixNano()),
+		Path:     "/",
+		MaxAge:   int((c.ReadYourWrites + time.Second - 1) / time.Second),
+		HttpOnly: true,
+	})
+}
@@ -0,0 +1,144 @@
+package aqua
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type city struct {
+	Id   int
+	Name string
+}
+
+func TestCrudReplicas(t *testing.T) {
+
+	// each database holds the same city under a different name, which
+	// tells where a read was served from
+	dbs := make([]string, 3)
+	for i, name := range []string{"primary", "one", "two"} {
+		f, _ := ioutil.TempFile("", "replica")
+		f.Close()
+		defer os.Remove(f.Name())
+		dbs[i] = f.Name()
+
+		db, _ := gorm.Open("sqlite3", f.Name())
+		db.AutoMigrate(&city{})
+		db.Create(&city{Id: 1, Name: name})
+		db.Close()
+	}
+
+	newCrud := func(replicas ...string) *CRUD {
+		c := &CRUD{
+			Storage:  cstr.Storage{Engine: "sqlite3", Conn: dbs[0]},
+			Replicas: replicas,
+			Model: func() (interface{}, interface{}) {
+				return &city{}, &[]city{}
+			},
+		}
+		c.validate()
+		return c
+	}
+	read := func(c *CRUD, r *http.Request) string {
+		if r == nil {
+			r, _ = http.NewRequest("GET", "/cities/1", nil)
+		}
+		out := c.Rdbms_Read("1", NewAide(httptest.NewRecorder(), r))
+		if m, ok := out.(*city); ok {
+			return m.Name
+		}
+		return ""
+	}
+	update := func(c *CRUD, w http.ResponseWriter, name string) {
+		r, _ := http.NewRequest("PUT", "/cities/1", strings.NewReader(`{"Name":"`+name+`"}`))
+		j := NewAide(w, r)
+		c.Rdbms_Update("1", j)
+		j.txs.commit()
+	}
+
+	Convey("Given a CRUD with replicas", t, func() {
+		c := newCrud(dbs[1], dbs[2])
+
+		Convey("Then reads should go to the replicas in turn", func() {
+			names := []string{read(c, nil), read(c, nil), read(c, nil), read(c, nil)}
+			So(names, ShouldResemble, []string{"one", "two", "one", "two"})
+		})
+		Convey("Then lists should go to the replicas too", func() {
+			r, _ := http.NewRequest("GET", "/cities", nil)
+			out := c.Rdbms_List(NewAide(httptest.NewRecorder(), r))
+			So((*out.(*[]city))[0].Name, ShouldNotEqual, "primary")
+		})
+		Convey("Then writes should go to the primary", func() {
+			update(c, httptest.NewRecorder(), "changed")
+
+			db, _ := gorm.Open("sqlite3", dbs[0])
+			defer db.Close()
+			m := city{}
+			db.First(&m, 1)
+			So(m.Name, ShouldEqual, "changed")
+			update(c, httptest.NewRecorder(), "primary")
+		})
+	})
+
+	Convey("Given a CRUD with an unreachable replica", t, func() {
+		c := newCrud("/nonexistent/dir/replica.db", dbs[2])
+
+		Convey("Then it should be skipped", func() {
+			So([]string{read(c, nil), read(c, nil), read(c, nil)}, ShouldResemble, []string{"two", "two", "two"})
+		})
+	})
+
+	Convey("Given a CRUD whose replicas are all unreachable", t, func() {
+		c := newCrud("/nonexistent/dir/replica.db")
+
+		Convey("Then reads should fall back to the primary", func() {
+			So(read(c, nil), ShouldEqual, "primary")
+		})
+	})
+
+	Convey("Given a CRUD with read your writes", t, func() {
+		c := newCrud(dbs[1])
+		c.ReadYourWrites = time.Minute
+
+		w := httptest.NewRecorder()
+		update(c, w, "primary")
+		cookies := w.Result().Cookies()
+
+		Convey("Then a write should pin the client to the primary", func() {
+			So(len(cookies), ShouldEqual, 1)
+			r, _ := http.NewRequest("GET", "/cities/1", nil)
+			r.AddCookie(cookies[0])
+			So(read(c, r), ShouldEqual, "primary")
+		})
+		Convey("Then other clients should read from the replicas", func() {
+			So(read(c, nil), ShouldEqual, "one")
+		})
+		Convey("Then an expired pin should be ignored", func() {
+			r, _ := http.NewRequest("GET", "/cities/1", nil)
+			r.AddCookie(&http.Cookie{Name: pinCookie, Value: "1"})
+			So(read(c, r), ShouldEqual, "one")
+		})
+		Convey("Then a pin beyond ReadYourWrites should be ignored", func() {
+			r, _ := http.NewRequest("GET", "/cities/1", nil)
+			until := time.Now().Add(time.Hour).UnixNano()
+			r.AddCookie(&http.Cookie{Name: pinCookie, Value: strconv.FormatInt(until, 10)})
+			So(read(c, r), ShouldEqual, "one")
+		})
+	})
+
+	Convey("Given replicas on a non RDBMS crud", t, func() {
+		c := CRUD{Storage: cstr.Storage{Engine: "memcache", Conn: "localhost:11211"}, Replicas: []string{"x:1"}}
+		Convey("Then validation should fail", func() {
+			So(c.validate, ShouldPanic)
+		})
+	})
+}
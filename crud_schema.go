@@ -0,0 +1,221 @@
+package aqua
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/db/orm"
+)
+
+// SchemaMode tells the RestServer what to do with the tables of RDBMS CRUD
+// models as the endpoints are loaded (see RestServer.SetSchema)
+type SchemaMode int
+
+const (
+	// SchemaIgnore leaves the tables alone (default)
+	SchemaIgnore SchemaMode = iota
+	// SchemaMigrate creates missing tables and columns using gorm's AutoMigrate
+	SchemaMigrate
+	// SchemaCheck compares the models with the tables, and panics if a
+	// table or column is missing or a column type does not fit its field
+	SchemaCheck
+	// SchemaDryRun prints the DDL that SchemaMigrate would run
+	SchemaDryRun
+)
+
+// schemaDiff holds the differences between a model and its table
+type schemaDiff struct {
+	table  string
+	ddl    []string
+	issues []string
+}
+
+// diffSchema compares a model with its table in the database
+func diffSchema(dbo *gorm.DB, m interface{}) (schemaDiff, error) {
+	scope := dbo.NewScope(m)
+	d := schemaDiff{table: scope.TableName()}
+
+	fields := make([]*gorm.StructField, 0)
+	for _, f := range scope.GetModelStruct().StructFields {
+		if f.IsNormal && !f.IsIgnored {
+			fields = append(fields, f)
+		}
+	}
+
+	if !scope.Dialect().HasTable(d.table) {
+		d.issues = append(d.issues, "table "+d.table+" is missing")
+		d.ddl = append(d.ddl, createTableDDL(scope, fields))
+		return d, nil
+	}
+
+	// column types, as declared in the database
+	rows, err := dbo.DB().Query(fmt.Sprintf("SELECT * FROM %s WHERE 1=0", scope.QuotedTableName()))
+	if err != nil {
+		return d, err
+	}
+	defer rows.Close()
+	cts, err := rows.ColumnTypes()
+	if err != nil {
+		return d, err
+	}
+	live := make(map[string]string)
+	for _, ct := range cts {
+		live[strings.ToLower(ct.Name())] = ct.DatabaseTypeName()
+	}
+
+	for _, f := range fields {
+		dbType, found := live[strings.ToLower(f.DBName)]
+		if !found {
+			d.issues = append(d.issues, fmt.Sprintf("column %s.%s is missing", d.table, f.DBName))
+			d.ddl = append(d.ddl, fmt.Sprintf("ALTER TABLE %v ADD %v %v;",
+				scope.QuotedTableName(), scope.Quote(f.DBName), scope.Dialect().DataTypeOf(f)))
+			continue
+		}
+		want, got := goTypeClass(f.Struct.Type), sqlTypeClass(dbType)
+		if !compatibleTypes(want, got) {
+			d.issues = append(d.issues, fmt.Sprintf("column %s.%s is %s, which does not fit field %s (%s)",
+				d.table, f.DBName, dbType, f.Name, f.Struct.Type))
+		}
+	}
+	return d, nil
+}
+
+func createTableDDL(scope *gorm.Scope, fields []*gorm.StructField) string {
+	cols := make([]string, 0, len(fields))
+	pks := make([]string, 0)
+	pkInType := false
+	for _, f := range fields {
+		typ := scope.Dialect().DataTypeOf(f)
+		if strings.Contains(strings.ToLower(typ), "primary key") {
+			pkInType = true
+		}
+		cols = append(cols, scope.Quote(f.DBName)+" "+typ)
+		if f.IsPrimaryKey {
+			pks = append(pks, scope.Quote(f.DBName))
+		}
+	}
+	if len(pks) > 0 && !pkInType {
+		cols = append(cols, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(pks, ",")))
+	}
+	return fmt.Sprintf("CREATE TABLE %v (%s);", scope.QuotedTableName(), strings.Join(cols, ","))
+}
+
+var (
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	valuerType  = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+)
+
+// goTypeClass returns the broad class of a field type: number, bool, text,
+// time or binary. Types with their own scanning are not classified.
+func goTypeClass(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return "time"
+	}
+	if reflect.PtrTo(t).Implements(scannerType) || t.Implements(valuerType) {
+		return ""
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "text"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "binary"
+		}
+	}
+	return ""
+}
+
+// sqlTypeClass returns the broad class of a column type as named by the driver
+func sqlTypeClass(name string) string {
+	name = strings.ToUpper(name)
+	has := func(parts ...string) bool {
+		for _, p := range parts {
+			if strings.Contains(name, p) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case name == "":
+		return ""
+	case has("DATE", "TIME"):
+		return "time"
+	case has("BOOL"):
+		return "bool"
+	case has("INT", "DEC", "NUM", "REAL", "FLOA", "DOUB", "SERIAL"):
+		return "number"
+	case has("CHAR", "TEXT", "CLOB", "STRING", "UUID", "ENUM", "JSON"):
+		return "text"
+	case has("BLOB", "BINARY", "BYTEA"):
+		return "binary"
+	}
+	return ""
+}
+
+func compatibleTypes(want, got string) bool {
+	if want == "" || got == "" || want == got {
+		return true
+	}
+	// booleans are often stored as small integers (tinyint, bit)
+	if (want == "bool" && got == "number") || (want == "number" && got == "bool") {
+		return true
+	}
+	// text columns can hold anything, as long as the driver converts it
+	return want == "binary" && got == "text"
+}
+
+// syncSchema applies the schema mode of the server to the model of a crud
+func (c *CRUD) syncSchema(mode SchemaMode, out io.Writer) {
+	if mode == SchemaIgnore || c.getMethod("create") != "Rdbms_Create" {
+		return
+	}
+	m, _ := c.Model()
+	dbo := orm.GetConn(c.Engine, c.Conn)
+
+	if mode == SchemaMigrate {
+		if err := dbo.AutoMigrate(m).Error; err != nil {
+			panic(fmt.Sprintf("Crud model %T could not be migrated: %s", m, err))
+		}
+	}
+
+	d, err := diffSchema(dbo, m)
+	if err != nil {
+		panic(fmt.Sprintf("Crud model %T could not be checked: %s", m, err))
+	}
+
+	switch mode {
+	case SchemaMigrate:
+		// migrations add tables and columns, but do not change column types
+		for _, i := range d.issues {
+			fmt.Fprintln(out, "schema warning:", i)
+		}
+	case SchemaCheck:
+		if len(d.issues) > 0 {
+			panic(fmt.Sprintf("Crud model %T does not match table %s:\n  %s",
+				m, d.table, strings.Join(d.issues, "\n  ")))
+		}
+	case SchemaDryRun:
+		for _, i := range d.issues {
+			fmt.Fprintln(out, "-- "+i)
+		}
+		for _, s := range d.ddl {
+			fmt.Fprintln(out, s)
+		}
+	}
+}
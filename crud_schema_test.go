@@ -0,0 +1,114 @@
+package aqua
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type invoice struct {
+	Id       int
+	Customer string
+	Amount   float64
+	IssuedAt time.Time
+}
+
+type schemaService struct {
+	RestService
+	invoices CRUD
+	db       string
+}
+
+func (s *schemaService) Invoices() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "sqlite3", Conn: s.db},
+		Model: func() (interface{}, interface{}) {
+			return &invoice{}, &[]invoice{}
+		},
+	}
+}
+
+func TestCrudSchema(t *testing.T) {
+
+	tmp, _ := ioutil.TempFile("", "schema")
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	load := func(mode SchemaMode, out *bytes.Buffer) func() {
+		return func() {
+			s := NewRestServer()
+			s.SetSchema(mode)
+			s.schemaOut = out
+			s.AddService(&schemaService{db: tmp.Name()})
+			s.loadAllEndpoints()
+		}
+	}
+	exec := func(sql string) {
+		db, _ := gorm.Open("sqlite3", tmp.Name())
+		defer db.Close()
+		So(db.Exec(sql).Error, ShouldBeNil)
+	}
+
+	Convey("Given a CRUD model without a table", t, func() {
+		out := &bytes.Buffer{}
+
+		Convey("Then a check should fail", func() {
+			So(load(SchemaCheck, out), ShouldPanicWith,
+				"Crud model *aqua.invoice does not match table invoices:\n  table invoices is missing")
+		})
+		Convey("Then a dry run should print the create table", func() {
+			So(load(SchemaDryRun, out), ShouldNotPanic)
+			So(out.String(), ShouldContainSubstring, "-- table invoices is missing")
+			So(out.String(), ShouldContainSubstring, `CREATE TABLE "invoices"`)
+		})
+		Convey("Then the ignore mode should not touch the database", func() {
+			So(load(SchemaIgnore, out), ShouldNotPanic)
+			So(out.Len(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a table with a missing and a mismatched column", t, func() {
+		exec(`CREATE TABLE invoices (id integer primary key, customer integer, amount real)`)
+		defer exec(`DROP TABLE invoices`)
+		out := &bytes.Buffer{}
+
+		Convey("Then a check should report both", func() {
+			defer func() {
+				msg := recover().(string)
+				So(msg, ShouldContainSubstring, "column invoices.issued_at is missing")
+				So(msg, ShouldContainSubstring, "column invoices.customer is integer")
+			}()
+			load(SchemaCheck, out)()
+		})
+		Convey("Then a dry run should print the alter table only", func() {
+			load(SchemaDryRun, out)()
+			So(out.String(), ShouldContainSubstring, `ALTER TABLE "invoices" ADD "issued_at" datetime;`)
+			So(out.String(), ShouldNotContainSubstring, "CREATE TABLE")
+		})
+		Convey("Then migrating should add the column and warn about the type", func() {
+			load(SchemaMigrate, out)()
+			So(out.String(), ShouldContainSubstring, "schema warning: column invoices.customer")
+			So(out.String(), ShouldNotContainSubstring, "issued_at")
+
+			out.Reset()
+			load(SchemaDryRun, out)()
+			So(out.String(), ShouldNotContainSubstring, "ALTER TABLE")
+		})
+	})
+
+	Convey("Given a table that matches the model", t, func() {
+		exec(`CREATE TABLE invoices (id integer primary key, customer varchar(255), amount real, issued_at datetime)`)
+		defer exec(`DROP TABLE invoices`)
+
+		Convey("Then a check should pass", func() {
+			So(load(SchemaCheck, &bytes.Buffer{}), ShouldNotPanic)
+		})
+	})
+}
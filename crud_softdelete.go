@@ -0,0 +1,136 @@
+package aqua
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// With SoftDelete, a DELETE only stamps the DeletedAt column of the model and
+// soft deleted rows are left out of reads, lists and aggregates. They can be
+// seen using ?include_deleted=true and brought back by POST to {pkey}/restore,
+// both of which are allowed only if the principal of the request, as
+// identified by the Authorizer, matches the claim expression of CRUD.Admin.
+
+func (c *CRUD) validateSoftDelete(m interface{}) {
+	if !c.SoftDelete {
+		return
+	}
+	f, ok := modelField(m, "DeletedAt")
+	if !ok {
+		panic("Crud soft delete needs a DeletedAt column in the model")
+	}
+	if f.Type != reflect.TypeOf(&time.Time{}) {
+		panic("Crud soft delete needs DeletedAt to be of type *time.Time")
+	}
+}
+
+func includeDeleted(r *http.Request) bool {
+	v := r.URL.Query().Get("include_deleted")
+	return v == "true" || v == "1"
+}
+
+// isAdmin checks if the request is allowed admin access to the resource. The
+// request has already been through the Authorizer, which is not asked again
+// (its checks may use up nonces or quota), so the principal it established is
+// matched against Admin instead.
+func (c *CRUD) isAdmin(r *http.Request) bool {
+	p := principalOf(r)
+	return c.Admin != "" && c.auth != nil && p.Authenticated() && matchExpr(p.claims(), c.Admin)
+}
+
+func adminOnly(what string) error {
+	return Fault{
+		HTTPCode: 403,
+		Message:  "Admin access required",
+		Issue:    errors.New(what + " requires admin access"),
+	}
+}
+
+// guard is run by the crud endpoints before the endpoint cache is consulted,
+// so that the admin view is never served from cache to other callers
+func (c *CRUD) guard(r *http.Request) error {
+	if includeDeleted(r) {
+		if !c.SoftDelete {
+			return badParam("include_deleted is not supported")
+		}
+		if !c.isAdmin(r) {
+			return adminOnly("include_deleted")
+		}
+	}
+	return nil
+}
+
+// withDeleted lifts the soft delete scope for the admin view
+func (c *CRUD) withDeleted(db *gorm.DB, j Aide) *gorm.DB {
+	if c.SoftDelete && includeDeleted(j.Request) {
+		return db.Unscoped()
+	}
+	return db
+}
+
+// Rdbms_Restore clears DeletedAt of a soft deleted row. It is an update as
+// far as the hooks are concerned: they get the row as it was, with Data
+// clearing deleted_at.
+func (c *CRUD) Rdbms_Restore(primKey string, j Aide) interface{} {
+	if !c.isAdmin(j.Request) {
+		return adminOnly("restore")
+	}
+
+	m, _ := c.Model()
+
+	err := c.inTx(j, func(tx *gorm.DB) error {
+		h := c.newHook(j, m, tx)
+		h.Pkey = primKey
+		h.Data = map[string]interface{}{"deleted_at": nil}
+
+		qry, err := c.whereKey(c.scope(tx.Unscoped().Model(m), j), m, primKey)
+		if err != nil {
+			return err
+		}
+		qry = qry.Where("deleted_at IS NOT NULL")
+
+		// hooks get to see the row that is about to be restored
+		if c.hasHook(m, "beforeUpdate", "afterUpdate") {
+			if err := qry.First(m).Error; err != nil {
+				if err == gorm.ErrRecordNotFound {
+					return nothingToRestore()
+				}
+				return err
+			}
+		}
+		if err := c.hook("beforeUpdate", h); err != nil {
+			return err
+		}
+
+		planOf(reflect.TypeOf(m)).scrubData(h.Data)
+		h.Data["deleted_at"] = nil
+		stmt := qry.UpdateColumns(h.Data)
+		if stmt.Error != nil {
+			return stmt.Error
+		}
+		if stmt.RowsAffected == 0 {
+			return nothingToRestore()
+		}
+
+		return c.hook("afterUpdate", h)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.audit(j, "restore", primKey, nil, nil)
+	c.pin(j)
+	return map[string]interface{}{"success": 1}
+}
+
+func nothingToRestore() error {
+	return Fault{
+		HTTPCode: 404,
+		Message:  "Nothing to restore",
+		Issue:    gorm.ErrRecordNotFound,
+	}
+}
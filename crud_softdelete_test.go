@@ -0,0 +1,194 @@
+package aqua
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/db/cstr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type note struct {
+	Id        int
+	Text      string
+	DeletedAt *time.Time
+}
+
+// memo vetoes updates of locked memos, and notes the ones it lets through
+type memo struct {
+	Id        int
+	Text      string
+	DeletedAt *time.Time
+}
+
+var memoUpdates []string
+
+func (m *memo) CrudBeforeUpdate(h *Hook) error {
+	if m.Text == "locked" {
+		return errors.New("memo is locked")
+	}
+	memoUpdates = append(memoUpdates, h.Pkey)
+	return nil
+}
+
+type roleAuth struct{}
+
+// roleAuth lets a request through if its X-Role header matches allow
+func (a roleAuth) Authorize(r *http.Request, allow string, deny string) bool {
+	return allow == "" || r.Header.Get("X-Role") == allow
+}
+
+// Identify takes the caller to have the role of the X-Role header
+func (a roleAuth) Identify(r *http.Request, allow string, deny string) (Principal, error) {
+	p := principalOf(r)
+	if role := r.Header.Get("X-Role"); role != "" {
+		if p.Id == "" {
+			p.Id = role
+		}
+		p.Roles = []string{role}
+	}
+	if !a.Authorize(r, allow, deny) {
+		return p, Unauthenticated("", errAccessDenied)
+	}
+	return p, nil
+}
+
+type notesService struct {
+	RestService
+	notes CRUD
+}
+
+func (s *notesService) Notes() CRUD {
+	return CRUD{
+		Storage: cstr.Storage{Engine: "mysql", Conn: "blah"},
+		Model: func() (interface{}, interface{}) {
+			return &note{}, &[]note{}
+		},
+		SoftDelete: true,
+		Admin:      "role:admin",
+	}
+}
+
+func TestCrudSoftDelete(t *testing.T) {
+
+	Convey("Given a CRUD with soft delete", t, func() {
+		s := NewRestServer()
+		s.SetAuth(roleAuth{})
+		s.AddService(&notesService{})
+		s.loadAllEndpoints()
+
+		Convey("Then a restore endpoint should be setup", func() {
+			_, found := s.apis["POST:/notes/notes/{pkey}/restore"]
+			So(found, ShouldBeTrue)
+		})
+
+		c := CRUD{SoftDelete: true, Admin: "role:admin", auth: roleAuth{}}
+		admin := Principal{Id: "u1", Roles: []string{"admin"}}
+
+		Convey("Then the admin view should be allowed for admins only", func() {
+			r, _ := http.NewRequest("GET", "/notes/notes?include_deleted=true", nil)
+			err := c.guard(r)
+			So(err, ShouldNotBeNil)
+			So(err.(Fault).HTTPCode, ShouldEqual, 403)
+
+			r = WithPrincipal(r, Principal{Id: "u2", Roles: []string{"user"}})
+			So(c.guard(r), ShouldNotBeNil)
+
+			r = WithPrincipal(r, admin)
+			So(c.guard(r), ShouldBeNil)
+		})
+		Convey("Then Admin should be matched against the claims of the principal", func() {
+			c.Admin = "scope:notes.admin"
+			r, _ := http.NewRequest("GET", "/notes/notes?include_deleted=true", nil)
+			So(c.guard(WithPrincipal(r, admin)), ShouldNotBeNil)
+
+			p := Principal{Id: "u3", Claims: map[string]interface{}{"scope": "notes.read notes.admin"}}
+			So(c.guard(WithPrincipal(r, p)), ShouldBeNil)
+		})
+		Convey("Then requests without include_deleted should not be checked", func() {
+			r, _ := http.NewRequest("GET", "/notes/notes/1", nil)
+			So(c.guard(r), ShouldBeNil)
+		})
+		Convey("Then the admin view should be denied if no Admin is set", func() {
+			c.Admin = ""
+			r, _ := http.NewRequest("GET", "/notes/notes?include_deleted=1", nil)
+			So(c.guard(WithPrincipal(r, admin)), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a soft delete CRUD with update hooks", t, func() {
+		f, _ := ioutil.TempFile("", "memos")
+		f.Close()
+		defer os.Remove(f.Name())
+		db, _ := gorm.Open("sqlite3", f.Name())
+		db.AutoMigrate(&memo{})
+		db.Create(&memo{Id: 1, Text: "hello"})
+		db.Create(&memo{Id: 2, Text: "locked"})
+		db.Delete(&memo{Id: 1})
+		db.Delete(&memo{Id: 2})
+		db.Close()
+
+		c := &CRUD{
+			Storage: cstr.Storage{Engine: "sqlite3", Conn: f.Name()},
+			Model: func() (interface{}, interface{}) {
+				return &memo{}, &[]memo{}
+			},
+			SoftDelete: true,
+			Admin:      "role:admin",
+			auth:       roleAuth{},
+		}
+		c.validate()
+		memoUpdates = nil
+
+		restore := func(key string) interface{} {
+			r, _ := http.NewRequest("POST", "/memos/"+key+"/restore", nil)
+			j := NewAide(httptest.NewRecorder(), WithPrincipal(r, Principal{Id: "u1", Roles: []string{"admin"}}))
+			out := c.Rdbms_Restore(key, j)
+			j.txs.commit()
+			return out
+		}
+		deleted := func(key string) bool {
+			db, _ := gorm.Open("sqlite3", f.Name())
+			defer db.Close()
+			return db.First(&memo{}, key).RecordNotFound()
+		}
+
+		Convey("Then restore should run the update hooks", func() {
+			So(restore("1"), ShouldResemble, map[string]interface{}{"success": 1})
+			So(memoUpdates, ShouldResemble, []string{"1"})
+			So(deleted("1"), ShouldBeFalse)
+
+			err := restore("1")
+			So(err.(Fault).HTTPCode, ShouldEqual, 404)
+		})
+		Convey("Then a hook should be able to veto the restore", func() {
+			err := restore("2")
+			So(err.(Fault).HTTPCode, ShouldEqual, 400)
+			So(deleted("2"), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a CRUD without soft delete", t, func() {
+		c := CRUD{}
+		Convey("Then include_deleted should be rejected", func() {
+			r, _ := http.NewRequest("GET", "/users?include_deleted=true", nil)
+			err := c.guard(r)
+			So(err, ShouldNotBeNil)
+			So(err.(Fault).HTTPCode, ShouldEqual, 400)
+		})
+	})
+
+	Convey("Given a soft delete CRUD whose model has no DeletedAt", t, func() {
+		Convey("Then validation should panic", func() {
+			c := CRUD{SoftDelete: true}
+			So(func() { c.validateSoftDelete(&sale{}) }, ShouldPanic)
+			So(func() { c.validateSoftDelete(&note{}) }, ShouldNotPanic)
+		})
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/carbocation/interpose"
 	"github.com/gorilla/mux"
 	"github.com/mayur-tolexo/aero/cache"
+	"github.com/mayur-tolexo/aero/refl"
 )
 
 var currentRepo string
@@ -32,6 +33,25 @@ type endPoint struct {
 	modules        []func(http.Handler) http.Handler
 	stash          cache.Cacher
 	auth           Authorizer
+	authFailed     AuthFailureFunc
+	ips            *ipRule
+
+	// rate limit of the endpoint, if any, and where its buckets are kept
+	rate  *rate
+	rates RateStore
+
+	// cors setup, if any, and the preflight handlers of the server by url
+	cors       *corsConfig
+	preflights map[string]*preflight
+
+	// security headers, if turned on
+	secure *secureHeaders
+
+	// optional check that runs before the cache is consulted
+	guard func(*http.Request) error
+
+	// route vars that make up the {pkey} of a composite crud key
+	keyVars []string
 
 	svcUrl string
 	svcId  string
@@ -77,6 +97,33 @@ func NewEndPoint(inv Invoker, f Fixture, httpMethod string, mods map[string]func
 		}
 	}
 
+	if rl, err := newIpRule(f); err != nil {
+		panic(fmt.Sprintf("%s for %s", err, out.urlWoVersion))
+	} else {
+		out.ips = rl
+	}
+
+	if f.Rate != "" {
+		rt, err := parseRate(f.Rate, f.RateBy)
+		if err != nil {
+			panic(fmt.Sprintf("%s for %s", err, out.urlWoVersion))
+		}
+		out.rate = &rt
+		out.rates = MemoryRates()
+	}
+
+	if c, err := newCors(f); err != nil {
+		panic(fmt.Sprintf("%s for %s", err, out.urlWoVersion))
+	} else {
+		out.cors = c
+	}
+
+	if s, err := newSecureHeaders(f); err != nil {
+		panic(fmt.Sprintf("%s for %s", err, out.urlWoVersion))
+	} else {
+		out.secure = s
+	}
+
 	// Figure out which cache store to use, unless it is a mock stub
 	if f.Stub == "" {
 		if c, ok := caches[f.Cache]; ok {
@@ -209,26 +256,39 @@ func (me *endPoint) setupMuxHandlers(mux *mux.Router) (svcUrl string) {
 	fn := handleIncoming(me)
 	m.UseHandler(http.HandlerFunc(fn))
 
+	var h http.Handler = m
+	if me.cors != nil {
+		h = me.cors.wrap(h)
+	}
+	if me.secure != nil {
+		h = me.secure.wrap(h)
+	}
+
 	if me.config.Version == "" {
 		// url without version
 		svcUrl = me.urlWoVersion
-		mux.Handle(me.urlWoVersion, m).Methods(me.httpMethod)
+		mux.Handle(me.urlWoVersion, h).Methods(me.httpMethod)
+		me.answerPreflight(mux, me.urlWoVersion)
 		fmt.Printf("%s:%s\r\n", me.httpMethod, me.urlWoVersion)
 
 		// TODO: should we add content type application+json here?
 	} else {
 		// versioned url
 		svcUrl = me.urlWithVersion
-		mux.Handle(me.urlWithVersion, m).Methods(me.httpMethod)
+		mux.Handle(me.urlWithVersion, h).Methods(me.httpMethod)
+		me.answerPreflight(mux, me.urlWithVersion)
 		fmt.Printf("%s:%s\r\n", me.httpMethod, me.urlWithVersion)
 
 		// content type (style1)
 		header1 := fmt.Sprintf("application/%s-v%s+json", me.config.Vendor, me.config.Version)
-		mux.Handle(me.urlWoVersion, m).Methods(me.httpMethod).Headers("Accept", header1)
+		mux.Handle(me.urlWoVersion, h).Methods(me.httpMethod).Headers("Accept", header1)
 
 		// content type (style2)
 		header2 := fmt.Sprintf("application/%s+json;version=%s", me.config.Vendor, me.config.Version)
-		mux.Handle(me.urlWoVersion, m).Methods(me.httpMethod).Headers("Accept", header2)
+		mux.Handle(me.urlWoVersion, h).Methods(me.httpMethod).Headers("Accept", header2)
+
+		// preflights carry no Accept header of ours
+		me.answerPreflight(mux, me.urlWoVersion)
 	}
 
 	me.svcUrl = svcUrl
@@ -237,6 +297,21 @@ func (me *endPoint) setupMuxHandlers(mux *mux.Router) (svcUrl string) {
 	return me.svcId
 }
 
+// answerPreflight makes the server answer OPTIONS requests for the url, and
+// tells it the cors setup of the endpoint
+func (me *endPoint) answerPreflight(mux *mux.Router, url string) {
+	if me.preflights == nil {
+		return
+	}
+	p, found := me.preflights[url]
+	if !found {
+		p = &preflight{cors: make(map[string]*corsConfig)}
+		me.preflights[url] = p
+		mux.Handle(url, p).Methods("OPTIONS")
+	}
+	p.add(me.httpMethod, me.cors)
+}
+
 func handleIncoming(e *endPoint) func(http.ResponseWriter, *http.Request) {
 
 	// return stub
@@ -254,11 +329,37 @@ func handleIncoming(e *endPoint) func(http.ResponseWriter, *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
+		if e.ips != nil {
+			if err := e.ips.check(r); err != nil {
+				writeItem(w, r, refl.ObjSignature(err), reflect.ValueOf(err), e.config.Pretty)
+				return
+			}
+		}
+
 		// Authorization
 		if e.auth != nil {
-			if !e.auth.Authorize(r, e.config.Allow, e.config.Deny) {
-				w.WriteHeader(401)
-				w.Write([]byte(`{"message":"Unauthorized Access"}`))
+			var err error
+			if r, err = e.authorize(r); err != nil {
+				f := authFault(err)
+				if e.authFailed != nil {
+					e.authFailed(r, f)
+				}
+				writeItem(w, r, refl.ObjSignature(f), reflect.ValueOf(f), e.config.Pretty)
+				return
+			}
+		}
+
+		if e.rate != nil {
+			if err := e.rate.enforce(w, r, e.rates, e.svcId); err != nil {
+				writeItem(w, r, refl.ObjSignature(err), reflect.ValueOf(err), e.config.Pretty)
+				return
+			}
+		}
+
+		if e.guard != nil {
+			if err := e.guard(r); err != nil {
+				f := hookFault(err).(Fault)
+				writeItem(w, r, refl.ObjSignature(f), reflect.ValueOf(f), e.config.Pretty)
 				return
 			}
 		}
@@ -284,7 +385,15 @@ func handleIncoming(e *endPoint) func(http.ResponseWriter, *http.Request) {
 		muxVals := mux.Vars(r)
 		params := make([]string, len(e.muxVars))
 		for i, k := range e.muxVars {
-			params[i] = muxVals[k]
+			if k == "pkey" && len(e.keyVars) > 0 {
+				parts := make([]string, len(e.keyVars))
+				for n, v := range e.keyVars {
+					parts[n] = muxVals[v]
+				}
+				params[i] = strings.Join(parts, "/")
+			} else {
+				params[i] = muxVals[k]
+			}
 		}
 
 		if e.stdHandler {
@@ -292,16 +401,23 @@ func handleIncoming(e *endPoint) func(http.ResponseWriter, *http.Request) {
 			e.exec.Do([]reflect.Value{reflect.ValueOf(w), reflect.ValueOf(r)})
 		} else {
 			ref := convertToType(params, e.exec.inpParams)
+			var aide *Aide
 			if e.needsAide {
-				ref = append(ref, reflect.ValueOf(NewAide(w, r)))
+				j := NewAide(w, r)
+				aide = &j
+				ref = append(ref, reflect.ValueOf(j))
 			}
 
 			if useCache {
-				val, err = e.stash.Get(r.RequestURI)
+				val, err = e.stash.Get(cacheKey(r))
 				if err == nil {
 					out = decode(val, e.exec.outParams)
 				} else {
-					out = e.exec.Do(ref)
+					out, err = e.invoke(ref, aide)
+					if err != nil {
+						writeTxFault(w, r, err, e.config.Pretty)
+						return
+					}
 					if len(out) == 2 && e.exec.outParams[0] == "int" {
 						code := out[0].Int()
 						if code < 200 || code > 299 {
@@ -310,13 +426,45 @@ func handleIncoming(e *endPoint) func(http.ResponseWriter, *http.Request) {
 					}
 					if useCache {
 						bytes := encode(out, e.exec.outParams)
-						e.stash.Set(r.RequestURI, bytes, ttl)
+						e.stash.Set(cacheKey(r), bytes, ttl)
 					}
 				}
 			} else {
-				out = e.exec.Do(ref)
+				out, err = e.invoke(ref, aide)
+				if err != nil {
+					writeTxFault(w, r, err, e.config.Pretty)
+					return
+				}
 			}
 			writeOutput(w, r, e.exec.outParams, out, e.config.Pretty)
 		}
 	}
 }
+
+// authorize checks the caller against the allow and deny tags and returns
+// the request carrying the principal the authorizer has established. Plain
+// authorizers cannot tell why they refuse a caller, so it is taken as a 401.
+func (e *endPoint) authorize(r *http.Request) (*http.Request, error) {
+	ia, ok := e.auth.(IdentityAuthorizer)
+	if !ok {
+		if !e.auth.Authorize(r, e.config.Allow, e.config.Deny) {
+			return r, Unauthenticated("", errAccessDenied)
+		}
+		return r, nil
+	}
+	p, err := ia.Identify(r, e.config.Allow, e.config.Deny)
+	if p.Authenticated() {
+		r = WithPrincipal(r, p)
+	}
+	return r, err
+}
+
+// cacheKey keeps apart the cached responses of different callers, as the
+// fields a caller gets to see may depend on who they are
+func cacheKey(r *http.Request) string {
+	p := principalOf(r)
+	if !p.Authenticated() {
+		return r.RequestURI
+	}
+	return r.RequestURI + "|" + p.Id + "|" + strings.Join(p.Roles, ",")
+}
@@ -1,6 +1,7 @@
 package aqua
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 )
@@ -10,6 +11,9 @@ type Fault struct {
 	Message  string `json:"message"`
 	Desc     string `json:"desc"`
 	Issue    error  `json:"issue"`
+
+	// sent as WWW-Authenticate along with a 401
+	challenge string
 }
 
 func (f Fault) MarshalJSON() ([]byte, error) {
@@ -45,5 +49,44 @@ func (f *Fault) Set(err error, desc ...string) *Fault {
 
 // Fault implements error interface
 func (f Fault) Error() string {
+	if f.Issue == nil {
+		return f.Message
+	}
 	return f.Issue.Error()
 }
+
+// Unauthenticated is the fault of a caller without valid credentials (401).
+// The challenge tells the client how to authenticate, e.g. Bearer.
+func Unauthenticated(challenge string, err error) Fault {
+	if challenge == "" {
+		challenge = "Bearer"
+	}
+	return Fault{
+		HTTPCode:  401,
+		Message:   "Unauthorized Access",
+		Issue:     err,
+		challenge: challenge,
+	}
+}
+
+// Forbidden is the fault of a caller that is known, but not allowed in (403)
+func Forbidden(err error) Fault {
+	return Fault{
+		HTTPCode: 403,
+		Message:  "Forbidden",
+		Issue:    err,
+	}
+}
+
+var errAccessDenied = errors.New("access denied")
+
+// authFault turns the error of an authorizer into a 401 or 403 fault
+func authFault(err error) Fault {
+	switch f := err.(type) {
+	case Fault:
+		return f
+	case *Fault:
+		return *f
+	}
+	return Unauthenticated("", err)
+}
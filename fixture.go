@@ -2,6 +2,7 @@ package aqua
 
 import (
 	"reflect"
+	"strings"
 )
 
 type Fixture struct {
@@ -22,6 +23,35 @@ type Fixture struct {
 	// acl
 	Allow string
 	Deny  string
+
+	// ips and cidrs let in and kept out, before the acl is checked
+	AllowIp string
+	DenyIp  string
+
+	// rate limit, e.g. 100/m, per client ip, api key or principal
+	Rate   string
+	RateBy string
+
+	// cors: origins, methods, headers, credentials and max-age (see corsConfig)
+	Cors            string
+	CorsMethods     string
+	CorsHeaders     string
+	CorsCredentials string
+	CorsMaxAge      string
+
+	// security headers, with the csp and cache-control to send
+	Secure       string
+	Csp          string
+	CacheControl string
+
+	// crud: acl per verb, and the routes to setup
+	AllowRead   string
+	AllowWrite  string
+	AllowDelete string
+	DenyRead    string
+	DenyWrite   string
+	DenyDelete  string
+	Ops         string
 }
 
 func NewFixtureFromTag(i interface{}, fieldName string) Fixture {
@@ -96,6 +126,101 @@ func NewFixtureFromTag(i interface{}, fieldName string) Fixture {
 		out.Deny = tmp
 	}
 
+	tmp = getTagValue(tag, "allow_ip")
+	if tmp != "" {
+		out.AllowIp = tmp
+	}
+
+	tmp = getTagValue(tag, "deny_ip")
+	if tmp != "" {
+		out.DenyIp = tmp
+	}
+
+	tmp = getTagValue(tag, "rate")
+	if tmp != "" {
+		out.Rate = tmp
+	}
+
+	tmp = getTagValue(tag, "rate_by")
+	if tmp != "" {
+		out.RateBy = tmp
+	}
+
+	tmp = getTagValue(tag, "cors")
+	if tmp != "" {
+		out.Cors = tmp
+	}
+
+	tmp = getTagValue(tag, "cors_methods")
+	if tmp != "" {
+		out.CorsMethods = tmp
+	}
+
+	tmp = getTagValue(tag, "cors_headers")
+	if tmp != "" {
+		out.CorsHeaders = tmp
+	}
+
+	tmp = getTagValue(tag, "cors_credentials")
+	if tmp != "" {
+		out.CorsCredentials = tmp
+	}
+
+	tmp = getTagValue(tag, "cors_max_age")
+	if tmp != "" {
+		out.CorsMaxAge = tmp
+	}
+
+	tmp = getTagValue(tag, "secure")
+	if tmp != "" {
+		out.Secure = tmp
+	}
+
+	tmp = getTagValue(tag, "csp")
+	if tmp != "" {
+		out.Csp = tmp
+	}
+
+	tmp = getTagValue(tag, "cache_control")
+	if tmp != "" {
+		out.CacheControl = tmp
+	}
+
+	tmp = getTagValue(tag, "allow_read")
+	if tmp != "" {
+		out.AllowRead = tmp
+	}
+
+	tmp = getTagValue(tag, "allow_write")
+	if tmp != "" {
+		out.AllowWrite = tmp
+	}
+
+	tmp = getTagValue(tag, "allow_delete")
+	if tmp != "" {
+		out.AllowDelete = tmp
+	}
+
+	tmp = getTagValue(tag, "deny_read")
+	if tmp != "" {
+		out.DenyRead = tmp
+	}
+
+	tmp = getTagValue(tag, "deny_write")
+	if tmp != "" {
+		out.DenyWrite = tmp
+	}
+
+	tmp = getTagValue(tag, "deny_delete")
+	if tmp != "" {
+		out.DenyDelete = tmp
+	}
+
+	tmp = getTagValue(tag, "ops")
+	if tmp != "" {
+		out.Ops = tmp
+	}
+
 	return out
 }
 
@@ -114,6 +239,10 @@ func resolveInOrder(e ...Fixture) Fixture {
 	empty := ""
 
 	for _, ep := range e {
+		// allow and deny stand for the verbs without an acl of their own at
+		// the same level, so that a less specific level cannot override them
+		ep = ep.verbAcl()
+
 		if out.Prefix == empty && ep.Prefix != empty {
 			out.Prefix = ep.Prefix
 		}
@@ -153,6 +282,106 @@ func resolveInOrder(e ...Fixture) Fixture {
 		if out.Deny == empty && ep.Deny != empty {
 			out.Deny = ep.Deny
 		}
+		if out.AllowIp == empty && ep.AllowIp != empty {
+			out.AllowIp = ep.AllowIp
+		}
+		if out.DenyIp == empty && ep.DenyIp != empty {
+			out.DenyIp = ep.DenyIp
+		}
+		if out.Rate == empty && ep.Rate != empty {
+			out.Rate = ep.Rate
+		}
+		if out.RateBy == empty && ep.RateBy != empty {
+			out.RateBy = ep.RateBy
+		}
+		if out.Cors == empty && ep.Cors != empty {
+			out.Cors = ep.Cors
+		}
+		if out.CorsMethods == empty && ep.CorsMethods != empty {
+			out.CorsMethods = ep.CorsMethods
+		}
+		if out.CorsHeaders == empty && ep.CorsHeaders != empty {
+			out.CorsHeaders = ep.CorsHeaders
+		}
+		if out.CorsCredentials == empty && ep.CorsCredentials != empty {
+			out.CorsCredentials = ep.CorsCredentials
+		}
+		if out.CorsMaxAge == empty && ep.CorsMaxAge != empty {
+			out.CorsMaxAge = ep.CorsMaxAge
+		}
+		if out.Secure == empty && ep.Secure != empty {
+			out.Secure = ep.Secure
+		}
+		if out.Csp == empty && ep.Csp != empty {
+			out.Csp = ep.Csp
+		}
+		if out.CacheControl == empty && ep.CacheControl != empty {
+			out.CacheControl = ep.CacheControl
+		}
+		if out.AllowRead == empty && ep.AllowRead != empty {
+			out.AllowRead = ep.AllowRead
+		}
+		if out.AllowWrite == empty && ep.AllowWrite != empty {
+			out.AllowWrite = ep.AllowWrite
+		}
+		if out.AllowDelete == empty && ep.AllowDelete != empty {
+			out.AllowDelete = ep.AllowDelete
+		}
+		if out.DenyRead == empty && ep.DenyRead != empty {
+			out.DenyRead = ep.DenyRead
+		}
+		if out.DenyWrite == empty && ep.DenyWrite != empty {
+			out.DenyWrite = ep.DenyWrite
+		}
+		if out.DenyDelete == empty && ep.DenyDelete != empty {
+			out.DenyDelete = ep.DenyDelete
+		}
+		if out.Ops == empty && ep.Ops != empty {
+			out.Ops = ep.Ops
+		}
 	}
 	return out
 }
+
+// verbAcl fills in the acl of each crud verb with allow and deny
+func (f Fixture) verbAcl() Fixture {
+	f.AllowRead, f.DenyRead = f.acl("read")
+	f.AllowWrite, f.DenyWrite = f.acl("write")
+	f.AllowDelete, f.DenyDelete = f.acl("delete")
+	return f
+}
+
+// acl returns the allow and deny for a crud verb (read, write or delete),
+// falling back to the ones of the endpoint
+func (f Fixture) acl(verb string) (allow string, deny string) {
+	allow, deny = f.Allow, f.Deny
+	switch verb {
+	case "read":
+		allow, deny = pick(f.AllowRead, allow), pick(f.DenyRead, deny)
+	case "write":
+		allow, deny = pick(f.AllowWrite, allow), pick(f.DenyWrite, deny)
+	case "delete":
+		allow, deny = pick(f.AllowDelete, allow), pick(f.DenyDelete, deny)
+	}
+	return allow, deny
+}
+
+// hasOp checks if a crud op is enabled. All ops are enabled by default.
+func (f Fixture) hasOp(op string) bool {
+	if f.Ops == "" {
+		return true
+	}
+	for _, o := range strings.Split(f.Ops, ",") {
+		if strings.TrimSpace(o) == op {
+			return true
+		}
+	}
+	return false
+}
+
+func pick(val string, fallback string) string {
+	if val != "" {
+		return val
+	}
+	return fallback
+}
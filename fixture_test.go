@@ -53,3 +53,39 @@ func TestNewFixtureFromTag(t *testing.T) {
 		})
 	})
 }
+
+func TestCrudAclFromTag(t *testing.T) {
+
+	Convey("Given a CRUD field with acl per verb", t, func() {
+
+		type aStruct struct {
+			aField string `allow:"all" allow_write:"admin" deny_delete:"guest" ops:"read,list"`
+		}
+		a := aStruct{}
+		f := NewFixtureFromTag(&a, "aField")
+
+		Convey("Then the tags should be loaded", func() {
+			So(f.AllowWrite, ShouldEqual, "admin")
+			So(f.DenyDelete, ShouldEqual, "guest")
+			So(f.Ops, ShouldEqual, "read,list")
+		})
+		Convey("Then verbs without their own acl should use allow and deny", func() {
+			allow, deny := f.acl("read")
+			So(allow, ShouldEqual, "all")
+			So(deny, ShouldEqual, "")
+
+			allow, _ = f.acl("write")
+			So(allow, ShouldEqual, "admin")
+
+			allow, deny = f.acl("delete")
+			So(allow, ShouldEqual, "all")
+			So(deny, ShouldEqual, "guest")
+		})
+		Convey("Then only the listed ops should be enabled", func() {
+			So(f.hasOp("read"), ShouldBeTrue)
+			So(f.hasOp("list"), ShouldBeTrue)
+			So(f.hasOp("delete"), ShouldBeFalse)
+			So(Fixture{}.hasOp("delete"), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,107 @@
+package aqua
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// KeyService serves the admin endpoints of api keys: GET /aqua/keys lists
+// them, POST /aqua/keys creates one and DELETE /aqua/keys/{id} revokes one.
+// They are open only to callers that pass the admin expression, so the
+// server must have an Authorizer (see RestServer.SetAuth).
+type KeyService struct {
+	RestService `root:"/aqua/"`
+	listKeys    GET    `url:"/keys"`
+	createKey   POST   `url:"/keys"`
+	revokeKey   DELETE `url:"/keys/{id}"`
+
+	store KeyStore
+}
+
+// NewKeyService returns the admin endpoints of the keys in the given store,
+// e.g. NewKeyService(store, "scope:keys.admin")
+func NewKeyService(store KeyStore, admin string) *KeyService {
+	if admin == "" || public(admin) {
+		panic("KeyService needs an admin expression")
+	}
+	s := &KeyService{store: store}
+	s.Allow = admin
+	return s
+}
+
+// ListKeys returns all keys, without their hashes
+func (me *KeyService) ListKeys() interface{} {
+	keys, err := me.store.List()
+	if err != nil {
+		return Fault{HTTPCode: 500, Message: "Keys could not be listed", Issue: err}
+	}
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	return keys
+}
+
+// CreateKey creates a key from a body like
+// {"name": "billing", "scopes": ["orders.read"], "quota": 1000, "ttl": "720h"}
+// and returns it along with the key itself, which is shown only this once
+func (me *KeyService) CreateKey(j Aide) interface{} {
+	j.LoadVars()
+	var in struct {
+		Name    string    `json:"name"`
+		Scopes  []string  `json:"scopes"`
+		Quota   int       `json:"quota"`
+		Expires time.Time `json:"expires"`
+		Ttl     string    `json:"ttl"`
+	}
+	if err := json.Unmarshal([]byte(j.Body), &in); err != nil {
+		return badParam("Key could not be read: " + err.Error())
+	}
+	if in.Name == "" {
+		return badParam("Key name not specified")
+	}
+	if in.Quota < 0 {
+		return badParam("Key quota cannot be negative")
+	}
+
+	k, key, err := NewApiKey(in.Name, in.Scopes...)
+	if err != nil {
+		return Fault{HTTPCode: 500, Message: "Key could not be created", Issue: err}
+	}
+	k.Quota = in.Quota
+	k.Expires = in.Expires
+	if in.Ttl != "" {
+		ttl, err := time.ParseDuration(in.Ttl)
+		if err != nil || ttl <= 0 {
+			return badParam("Invalid key ttl " + in.Ttl)
+		}
+		k.Expires = k.Created.Add(ttl)
+	}
+	if err := me.store.Add(k); err != nil {
+		return Fault{HTTPCode: 500, Message: "Key could not be saved", Issue: err}
+	}
+
+	k.Hash = ""
+	return map[string]interface{}{"key": key, "api_key": k}
+}
+
+// RevokeKey revokes a key; it is kept, so that it still shows in the list
+func (me *KeyService) RevokeKey(id string) interface{} {
+	keys, err := me.store.List()
+	if err != nil {
+		return Fault{HTTPCode: 500, Message: "Key could not be revoked", Issue: err}
+	}
+	found := false
+	for _, k := range keys {
+		if k.Id == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return keyNotFound(id)
+	}
+	if err = me.store.Revoke(id); err != nil {
+		return Fault{HTTPCode: 500, Message: "Key could not be revoked", Issue: err}
+	}
+	return map[string]interface{}{"success": 1}
+}
@@ -21,7 +21,7 @@ func ModAccessLog(path string) func(http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 			next.ServeHTTP(w, r)
-			l.Printf("%s %s %.3f", r.Method, r.RequestURI, time.Since(start).Seconds())
+			l.Printf("%s %s %s %.3f", clientIP(r), r.Method, r.RequestURI, time.Since(start).Seconds())
 		})
 	}
 }
@@ -40,7 +40,7 @@ func ModSlowLog(path string, msec int) func(http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			dur := time.Since(start).Seconds() - float64(msec)/1000.0
 			if dur > 0 {
-				l.Printf("%s %s %.3f", r.Method, r.RequestURI, time.Since(start).Seconds())
+				l.Printf("%s %s %s %.3f", clientIP(r), r.Method, r.RequestURI, time.Since(start).Seconds())
 			}
 		})
 	}
@@ -0,0 +1,207 @@
+package aqua
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The allow_ip and deny_ip tags hold ips and cidrs separated by commas, e.g.
+// allow_ip:"10.0.0.0/8,192.168.1.7". The name private stands for the private
+// and loopback ranges. They are checked before the Authorizer, against the
+// client ip: the address the request came from or, if that is a trusted
+// proxy (see RestServer.SetTrustedProxies), the client it forwarded for.
+
+var privateNets = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8",
+	"fc00::/7", "::1/128"}
+
+// parseNets reads a list of ips and cidrs
+func parseNets(list string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0)
+	for _, s := range splitExpr(list) {
+		if s == "private" {
+			for _, p := range privateNets {
+				_, n, _ := net.ParseCIDR(p)
+				out = append(out, n)
+			}
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", s)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", s)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func inNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipRule is the allow_ip/deny_ip of an endpoint
+type ipRule struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newIpRule(f Fixture) (*ipRule, error) {
+	if f.AllowIp == "" && f.DenyIp == "" {
+		return nil, nil
+	}
+	allow, err := parseNets(f.AllowIp)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseNets(f.DenyIp)
+	if err != nil {
+		return nil, err
+	}
+	return &ipRule{allow: allow, deny: deny}, nil
+}
+
+// check returns a 403 fault for a client that is denied, or not allowed
+func (rl *ipRule) check(r *http.Request) error {
+	s := clientIP(r)
+	ip := net.ParseIP(s)
+	if ip == nil || inNets(rl.deny, ip) || (len(rl.allow) > 0 && !inNets(rl.allow, ip)) {
+		return Forbidden(fmt.Errorf("ip %s not allowed", s))
+	}
+	return nil
+}
+
+type clientKey struct{}
+
+// client is what the server found out about the client of a request
+type client struct {
+	ip    string
+	https bool
+}
+
+// clientIP returns the ip of the client, as found by the server, or else the
+// address the request came from
+func clientIP(r *http.Request) string {
+	if c, ok := r.Context().Value(clientKey{}).(client); ok {
+		return c.ip
+	}
+	return remoteIP(r)
+}
+
+// clientHttps checks if the client called over https, to us or to a trusted
+// proxy (as told by X-Forwarded-Proto or the proto of Forwarded)
+func clientHttps(r *http.Request) bool {
+	if c, ok := r.Context().Value(clientKey{}).(client); ok {
+		return c.https
+	}
+	return r.TLS != nil
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// resolveClient finds the client ip of each request, and passes it on to the
+// modules and endpoints through the request context
+func resolveClient(next http.Handler, proxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := client{ip: forwardedFor(r, proxies), https: r.TLS != nil}
+		if ip := net.ParseIP(remoteIP(r)); !c.https && ip != nil && inNets(proxies, ip) {
+			c.https = forwardedProto(r) == "https"
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, c)))
+	})
+}
+
+// forwardedProto returns the scheme the client used to call the proxy
+func forwardedProto(r *http.Request) string {
+	if h := r.Header.Get("Forwarded"); h != "" {
+		// the first element is the one added by the proxy the client called
+		for _, pair := range strings.Split(strings.Split(h, ",")[0], ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "proto") {
+				return strings.ToLower(strings.Trim(kv[1], `"`))
+			}
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]))
+}
+
+// forwardedFor walks the chain of proxies back from the address the request
+// came from, for as long as they are trusted, and returns the first hop that
+// is not. The Forwarded header is used if there is one, else X-Forwarded-For.
+func forwardedFor(r *http.Request, proxies []*net.IPNet) string {
+	ip := remoteIP(r)
+	if len(proxies) == 0 {
+		return ip
+	}
+	var hops []string
+	if h := r.Header["Forwarded"]; len(h) > 0 {
+		hops = forwardedHops(strings.Join(h, ","))
+	} else if h := r.Header["X-Forwarded-For"]; len(h) > 0 {
+		for _, s := range strings.Split(strings.Join(h, ","), ",") {
+			hops = append(hops, strings.TrimSpace(s))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		cur := net.ParseIP(ip)
+		if cur == nil || !inNets(proxies, cur) {
+			break
+		}
+		next := net.ParseIP(hops[i])
+		if next == nil {
+			// unknown or obfuscated, so the proxy is as far as we can tell
+			break
+		}
+		ip = next.String()
+	}
+	return ip
+}
+
+// forwardedHops returns the for= addresses of a Forwarded header (rfc 7239)
+func forwardedHops(h string) []string {
+	out := make([]string, 0)
+	for _, elem := range strings.Split(h, ",") {
+		hop := ""
+		for _, pair := range strings.Split(elem, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+				continue
+			}
+			v := strings.Trim(kv[1], `"`)
+			if strings.HasPrefix(v, "[") {
+				// [2001:db8::1]:4711
+				if i := strings.Index(v, "]"); i > 0 {
+					v = v[1:i]
+				}
+			} else if host, _, err := net.SplitHostPort(v); err == nil {
+				v = host
+			}
+			hop = v
+		}
+		out = append(out, hop)
+	}
+	return out
+}
@@ -0,0 +1,131 @@
+package aqua
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type intranetService struct {
+	RestService
+	report GET `url:"/report" allow_ip:"10.0.0.0/8"`
+	public GET `url:"/public" deny_ip:"203.0.113.0/24" mods:"log"`
+	quota  GET `url:"/quota" rate:"1/h" rate_by:"ip"`
+}
+
+func (s *intranetService) Report() string {
+	return "report"
+}
+
+func (s *intranetService) Public() string {
+	return "public"
+}
+
+func (s *intranetService) Quota() string {
+	return "ok"
+}
+
+func TestIpAcl(t *testing.T) {
+
+	Convey("Given lists of ips and cidrs", t, func() {
+		Convey("Then they should be parsed", func() {
+			nets, err := parseNets("10.0.0.0/8, 192.168.1.7, ::1")
+			So(err, ShouldBeNil)
+			So(len(nets), ShouldEqual, 3)
+			So(nets[1].String(), ShouldEqual, "192.168.1.7/32")
+			nets, _ = parseNets("private")
+			So(len(nets), ShouldEqual, len(privateNets))
+		})
+		Convey("Then invalid entries should be refused at startup", func() {
+			_, err := parseNets("10.0.0.0/33")
+			So(err, ShouldNotBeNil)
+			So(func() {
+				NewEndPoint(NewMethodInvoker(&intranetService{}, "Report"), Fixture{AllowIp: "intranet"}, "GET", nil, nil, nil)
+			}, ShouldPanic)
+		})
+	})
+
+	Convey("Given a request that came through proxies", t, func() {
+		proxies, _ := parseNets("10.0.0.0/8")
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.2:5000"
+		r.Header.Set("X-Forwarded-For", "198.51.100.9, 203.0.113.5, 10.0.0.1")
+
+		Convey("Then the client should be the first hop that is not trusted", func() {
+			So(forwardedFor(r, proxies), ShouldEqual, "203.0.113.5")
+		})
+		Convey("Then the headers should be ignored without trusted proxies", func() {
+			So(forwardedFor(r, nil), ShouldEqual, "10.0.0.2")
+			r.RemoteAddr = "192.0.2.1:5000"
+			So(forwardedFor(r, proxies), ShouldEqual, "192.0.2.1")
+		})
+		Convey("Then the Forwarded header should be preferred", func() {
+			r.Header.Set("Forwarded", `for=198.51.100.9;proto=https, for="[2001:db8::1]:4711", for=10.0.0.1:80`)
+			So(forwardedFor(r, proxies), ShouldEqual, "2001:db8::1")
+			r.Header.Set("Forwarded", `for=198.51.100.9, for=_hidden`)
+			So(forwardedFor(r, proxies), ShouldEqual, "10.0.0.2")
+		})
+	})
+
+	log, _ := ioutil.TempFile("", "access")
+	log.Close()
+	defer os.Remove(log.Name())
+
+	s := NewRestServer()
+	s.SetTrustedProxies("127.0.0.1")
+	s.AddModule("log", ModAccessLog(log.Name()))
+	s.AddService(&intranetService{})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	get := func(path string, from string) int {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/intranet%s", s.Port, path), nil)
+		if from != "" {
+			req.Header.Set("X-Forwarded-For", from)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	Convey("Given endpoints limited by ip, behind a trusted proxy", t, func() {
+
+		Convey("Then only the allowed networks should get in", func() {
+			So(get("/report", "10.1.2.3"), ShouldEqual, 200)
+			So(get("/report", "198.51.100.9"), ShouldEqual, 403)
+			So(get("/report", ""), ShouldEqual, 403)
+		})
+		Convey("Then denied networks should be kept out", func() {
+			So(get("/public", "203.0.113.77"), ShouldEqual, 403)
+			So(get("/public", "198.51.100.9"), ShouldEqual, 200)
+		})
+		Convey("Then the access log should show the client ip", func() {
+			time.Sleep(10 * time.Millisecond)
+			b, _ := ioutil.ReadFile(log.Name())
+			So(string(b), ShouldContainSubstring, "203.0.113.77 GET /intranet/public")
+			So(string(b), ShouldContainSubstring, "198.51.100.9 GET /intranet/public")
+			So(strings.Count(string(b), "127.0.0.1"), ShouldEqual, 0)
+		})
+		Convey("Then rate limits should count per client ip", func() {
+			So(get("/quota", "198.51.100.1"), ShouldEqual, 200)
+			So(get("/quota", "198.51.100.1"), ShouldEqual, 429)
+			So(get("/quota", "198.51.100.2"), ShouldEqual, 200)
+		})
+		Convey("Then /aqua/status should be open to private networks only", func() {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/aqua/status", s.Port), nil)
+			req.Header.Set("X-Forwarded-For", "198.51.100.9")
+			resp, _ := http.DefaultClient.Do(req)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, 403)
+		})
+	})
+}
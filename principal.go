@@ -0,0 +1,65 @@
+package aqua
+
+import (
+	"context"
+	"net/http"
+)
+
+// Principal describes the authenticated caller of a request
+type Principal struct {
+	Id     string
+	Roles  []string
+	Claims map[string]interface{}
+
+	// set for the api keys of KeyAuth
+	apiKey bool
+}
+
+// Authenticated returns true if the principal identifies a caller
+func (p Principal) Authenticated() bool {
+	return p.Id != ""
+}
+
+// HasRole checks if the principal was granted the given role
+func (p Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// claims returns the claims that claim expressions are matched against: those
+// of the principal, with its id as sub and its roles, unless already present
+func (p Principal) claims() map[string]interface{} {
+	out := make(map[string]interface{}, len(p.Claims)+2)
+	for k, v := range p.Claims {
+		out[k] = v
+	}
+	if _, found := out["sub"]; !found && p.Id != "" {
+		out["sub"] = p.Id
+	}
+	_, role := out["role"]
+	_, roles := out["roles"]
+	if !role && !roles && len(p.Roles) > 0 {
+		out["roles"] = p.Roles
+	}
+	return out
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of the request that carries the given principal.
+// Modules can use it to pass on the identity they have established.
+func WithPrincipal(r *http.Request, p Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+func principalOf(r *http.Request) Principal {
+	if r == nil {
+		return Principal{}
+	}
+	p, _ := r.Context().Value(principalKey{}).(Principal)
+	return p
+}
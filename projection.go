@@ -0,0 +1,501 @@
+package aqua
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mayur-tolexo/aero/refl"
+)
+
+// Fields of a struct can be protected using the aqua tag:
+//
+//   Password string `aqua:"writeonly"`      accepted on writes, never returned
+//   Flags    int    `aqua:"hidden"`         neither accepted nor returned
+//   Salary   int    `aqua:"roles=hr|admin"` returned to the given roles only
+//
+// Clients can further ask for a subset of fields using ?fields=id,name
+
+type fieldRule struct {
+	name      string // json name
+	column    string // db column
+	index     []int
+	primary   bool
+	hidden    bool
+	writeOnly bool
+	roles     []string
+	omitEmpty bool
+	typ       reflect.Type
+}
+
+type fieldPlan struct {
+	sign       string
+	typ        reflect.Type
+	fields     []fieldRule
+	restricted bool
+}
+
+var plans = struct {
+	sync.RWMutex
+	bySign  map[string]*fieldPlan
+	guarded map[reflect.Type]bool
+}{bySign: make(map[string]*fieldPlan), guarded: make(map[reflect.Type]bool)}
+
+// planOf returns the (cached) field plan of a struct type
+func planOf(t reflect.Type) *fieldPlan {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	sign := refl.TypeSignature(t)
+
+	plans.RLock()
+	p, found := plans.bySign[sign]
+	plans.RUnlock()
+	if found {
+		return p
+	}
+
+	p = &fieldPlan{sign: sign, typ: t, fields: make([]fieldRule, 0)}
+	p.collect(t, nil)
+
+	// as with gorm, id is the key unless fields are tagged primary_key
+	if len(p.keys()) == 0 {
+		for i := range p.fields {
+			if p.fields[i].column == "id" {
+				p.fields[i].primary = true
+			}
+		}
+	}
+
+	plans.Lock()
+	plans.bySign[sign] = p
+	plans.Unlock()
+	return p
+}
+
+// planOfSign returns the plan of a struct type that was seen earlier, which
+// is needed for values that come back from the endpoint cache as maps
+func planOfSign(sign string) *fieldPlan {
+	sign = strings.TrimPrefix(sign, "*")
+	plans.RLock()
+	defer plans.RUnlock()
+	return plans.bySign[sign]
+}
+
+func (p *fieldPlan) collect(t reflect.Type, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		idx := append(append([]int{}, index...), i)
+
+		name, opts := f.Name, ""
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			spl := strings.SplitN(tag, ",", 2)
+			if spl[0] != "" {
+				name = spl[0]
+			}
+			if len(spl) > 1 {
+				opts = spl[1]
+			}
+		}
+
+		// embedded structs are flattened by encoding/json
+		if f.Anonymous && f.Tag.Get("json") == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				p.collect(ft, idx)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		r := fieldRule{
+			name:      name,
+			column:    gorm.ToDBName(f.Name),
+			index:     idx,
+			omitEmpty: strings.Contains(opts, "omitempty"),
+			typ:       f.Type,
+		}
+		for _, s := range strings.Split(f.Tag.Get("gorm"), ";") {
+			s = strings.TrimSpace(s)
+			switch {
+			case strings.HasPrefix(strings.ToLower(s), "column:"):
+				r.column = s[len("column:"):]
+			case strings.ToLower(s) == "primary_key":
+				r.primary = true
+			}
+		}
+		for _, s := range strings.Split(f.Tag.Get("aqua"), ",") {
+			s = strings.TrimSpace(s)
+			switch {
+			case s == "hidden" || s == "-":
+				r.hidden = true
+			case s == "writeonly":
+				r.writeOnly = true
+			case strings.HasPrefix(s, "roles="):
+				r.roles = strings.Split(s[len("roles="):], "|")
+			}
+		}
+		if r.hidden || r.writeOnly || len(r.roles) > 0 {
+			p.restricted = true
+		}
+		p.fields = append(p.fields, r)
+	}
+}
+
+var marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// projected checks if values of the plan are to be projected: those with
+// field rules, at any depth, and those asked for a subset of fields unless
+// their type does its own json marshalling
+func (p *fieldPlan) projected(fields []string) bool {
+	if p == nil {
+		return false
+	}
+	if guarded(p.typ) {
+		return true
+	}
+	marshals := p.typ.Implements(marshalerType) || reflect.PtrTo(p.typ).Implements(marshalerType)
+	return fields != nil && !marshals
+}
+
+// guarded checks if a type holds structs with field rules, at any depth
+func guarded(t reflect.Type) bool {
+	plans.RLock()
+	g, found := plans.guarded[t]
+	plans.RUnlock()
+	if found {
+		return g
+	}
+	g = guardedIn(t, make(map[reflect.Type]bool))
+	plans.Lock()
+	plans.guarded[t] = g
+	plans.Unlock()
+	return g
+}
+
+func guardedIn(t reflect.Type, seen map[reflect.Type]bool) bool {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return false
+	}
+	seen[t] = true
+	p := planOf(t)
+	if p.restricted {
+		return true
+	}
+	for _, r := range p.fields {
+		if guardedIn(r.typ, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r fieldRule) readableBy(who Principal) bool {
+	if r.hidden || r.writeOnly {
+		return false
+	}
+	if len(r.roles) == 0 {
+		return true
+	}
+	for _, role := range r.roles {
+		if who.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedFields returns the sparse fieldset asked for via ?fields=
+func requestedFields(r *http.Request) []string {
+	if r == nil || r.URL == nil {
+		return nil
+	}
+	fs := r.URL.Query().Get("fields")
+	if fs == "" {
+		return nil
+	}
+	out := make([]string, 0)
+	for _, f := range strings.Split(fs, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func wanted(name string, fields []string) bool {
+	if len(fields) == 0 {
+		return true
+	}
+	for _, f := range fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// columns returns the db columns to select for the requested fields. The
+// primary key is always selected so that associations can be preloaded.
+func (p *fieldPlan) columns(fields []string, who Principal) ([]string, error) {
+	out := make([]string, 0)
+	for _, f := range fields {
+		found := false
+		for _, r := range p.fields {
+			if r.name == f || r.column == f {
+				if !r.readableBy(who) {
+					break
+				}
+				found = true
+				if !r.primary {
+					out = append(out, r.column)
+				}
+			}
+		}
+		if !found {
+			return nil, Fault{
+				HTTPCode: 400,
+				Message:  "Unknown field " + f,
+				Issue:    errors.New("field not found or not readable: " + f),
+			}
+		}
+	}
+	for _, r := range p.fields {
+		if r.primary {
+			out = append([]string{r.column}, out...)
+		}
+	}
+	return out, nil
+}
+
+// view converts a struct into a map of its readable (and requested) fields
+func (p *fieldPlan) view(v reflect.Value, who Principal, fields []string) map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, r := range p.fields {
+		if !r.readableBy(who) || !wanted(r.name, fields) {
+			continue
+		}
+		fv, ok := fieldByIndex(v, r.index)
+		if !ok {
+			continue
+		}
+		if r.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		out[r.name] = scope(fv, who).Interface()
+	}
+	return out
+}
+
+// scope applies the field rules of the structs held by a field (through
+// pointers, slices, arrays and maps) and returns the value to marshal
+func scope(v reflect.Value, who Principal) reflect.Value {
+	if !v.IsValid() || !guarded(v.Type()) {
+		return v
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		return scope(v.Elem(), who)
+	case reflect.Struct:
+		return reflect.ValueOf(planOf(v.Type()).view(v, who, nil))
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return v
+		}
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = scope(v.Index(i), who).Interface()
+		}
+		return reflect.ValueOf(out)
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(reflect.MapOf(v.Type().Key(), anyType), v.Len())
+		for _, k := range v.MapKeys() {
+			out.SetMapIndex(k, scope(v.MapIndex(k), who))
+		}
+		return out
+	}
+	return v
+}
+
+var anyType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// filter drops unreadable (and unrequested) keys from a decoded struct
+func (p *fieldPlan) filter(m map[string]interface{}, who Principal, fields []string) map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, r := range p.fields {
+		if v, found := m[r.name]; found && r.readableBy(who) && wanted(r.name, fields) {
+			out[r.name] = scopeDecoded(v, r.typ, who)
+		}
+	}
+	return out
+}
+
+// scopeDecoded is scope for the value of a field of type t, as decoded from
+// the endpoint cache
+func scopeDecoded(v interface{}, t reflect.Type, who Principal) interface{} {
+	if v == nil || !guarded(t) {
+		return v
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if m, ok := v.(map[string]interface{}); ok {
+			return planOf(t).filter(m, who, nil)
+		}
+	case reflect.Slice, reflect.Array:
+		if a, ok := v.([]interface{}); ok {
+			out := make([]interface{}, len(a))
+			for i := range a {
+				out[i] = scopeDecoded(a[i], t.Elem(), who)
+			}
+			return out
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			out := make(map[string]interface{}, len(m))
+			for k := range m {
+				out[k] = scopeDecoded(m[k], t.Elem(), who)
+			}
+			return out
+		}
+	}
+	return v
+}
+
+// scrub resets the hidden fields of a model loaded from user input
+func (p *fieldPlan) scrub(m interface{}) {
+	v := reflect.ValueOf(m)
+	for _, r := range p.fields {
+		if r.hidden {
+			if fv, ok := fieldByIndex(v, r.index); ok && fv.CanSet() {
+				fv.Set(reflect.Zero(fv.Type()))
+			}
+		}
+	}
+}
+
+// scrubData drops the hidden fields from column updates
+func (p *fieldPlan) scrubData(data map[string]interface{}) {
+	for _, r := range p.fields {
+		if r.hidden {
+			delete(data, r.name)
+			delete(data, r.column)
+		}
+	}
+}
+
+// project applies the field rules and ?fields of a struct (or slice of
+// structs) for the caller of the request. Other values, and types with their
+// own MarshalJSON asked for ?fields, are returned as is.
+func project(val reflect.Value, sign string, r *http.Request) reflect.Value {
+	fields := requestedFields(r)
+	who := principalOf(r)
+
+	switch {
+	case val.Kind() == reflect.Struct:
+		p := planOf(val.Type())
+		if !p.projected(fields) {
+			return val
+		}
+		return reflect.ValueOf(p.view(val, who, fields))
+
+	case val.Kind() == reflect.Slice && val.Type().Elem().Kind() != reflect.Interface:
+		p := planOf(val.Type().Elem())
+		if !p.projected(fields) {
+			return val
+		}
+		out := make([]map[string]interface{}, val.Len())
+		for i := 0; i < val.Len(); i++ {
+			out[i] = p.view(val.Index(i), who, fields)
+		}
+		return reflect.ValueOf(out)
+
+	case val.Kind() == reflect.Map:
+		// struct decoded from the endpoint cache
+		m, ok := val.Interface().(map[string]interface{})
+		p := planOfSign(sign)
+		if !ok || !p.projected(fields) {
+			return val
+		}
+		return reflect.ValueOf(p.filter(m, who, fields))
+
+	case val.Kind() == reflect.Slice:
+		// slice decoded from the endpoint cache
+		a, ok := val.Interface().([]interface{})
+		p := planOfSign(strings.TrimPrefix(sign, "sl:"))
+		if !ok || !p.projected(fields) {
+			return val
+		}
+		out := make([]interface{}, len(a))
+		for i := range a {
+			if m, ok := a[i].(map[string]interface{}); ok {
+				out[i] = p.filter(m, who, fields)
+			} else {
+				out[i] = a[i]
+			}
+		}
+		return reflect.ValueOf(out)
+	}
+	return val
+}
+
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for _, x := range index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		if !v.IsValid() {
+			return reflect.Value{}, false
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package aqua
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type account struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	Password string `json:"password" aqua:"writeonly"`
+	Flags    int    `json:"flags" aqua:"hidden"`
+	Salary   int    `json:"salary" aqua:"roles=hr|admin"`
+}
+
+type team struct {
+	Name    string             `json:"name"`
+	Lead    *account           `json:"lead"`
+	Members []account          `json:"members"`
+	ByDesk  map[string]account `json:"by_desk"`
+}
+
+type shout struct {
+	Text string
+}
+
+func (s shout) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"said": s.Text + "!"})
+}
+
+type projService struct {
+	RestService
+	one    GET
+	many   GET
+	asHr   GET `url:"one-hr" mods:"hr"`
+	plain  GET
+	nested GET
+	custom GET
+}
+
+func (s *projService) One() account {
+	return account{Id: 1, Name: "jdoe", Password: "secret", Flags: 7, Salary: 100}
+}
+
+func (s *projService) Many() []account {
+	return []account{s.One(), s.One()}
+}
+
+func (s *projService) AsHr() account {
+	return s.One()
+}
+
+func (s *projService) Plain() Fixture {
+	return Fixture{Root: "r", Url: "u"}
+}
+
+func (s *projService) Nested() team {
+	a := s.One()
+	return team{Name: "ops", Lead: &a, Members: []account{a}, ByDesk: map[string]account{"d1": a}}
+}
+
+func (s *projService) Custom() shout {
+	return shout{Text: "hi"}
+}
+
+func modHr() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, WithPrincipal(r, Principal{Id: "u1", Roles: []string{"hr"}}))
+		})
+	}
+}
+
+func TestFieldProjection(t *testing.T) {
+
+	s := NewRestServer()
+	s.AddModule("hr", modHr())
+	s.AddService(&projService{})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	get := func(path string) map[string]interface{} {
+		url := fmt.Sprintf("http://localhost:%d/proj/%s", s.Port, path)
+		_, _, content := getUrl(url, nil)
+		var m map[string]interface{}
+		json.Unmarshal([]byte(content), &m)
+		return m
+	}
+
+	Convey("Given a handler returning a struct with protected fields", t, func() {
+		Convey("Then hidden, write-only and role restricted fields should not be returned", func() {
+			m := get("one")
+			So(m["name"], ShouldEqual, "jdoe")
+			So(m, ShouldNotContainKey, "password")
+			So(m, ShouldNotContainKey, "flags")
+			So(m, ShouldNotContainKey, "salary")
+		})
+		Convey("Then role restricted fields should be returned to the given roles", func() {
+			m := get("one-hr")
+			So(m["salary"], ShouldEqual, 100)
+			So(m, ShouldNotContainKey, "password")
+		})
+		Convey("Then ?fields should limit the fields returned", func() {
+			m := get("one?fields=id,password")
+			So(len(m), ShouldEqual, 1)
+			So(m["id"], ShouldEqual, 1)
+		})
+		Convey("Then slices of structs should be projected too", func() {
+			url := fmt.Sprintf("http://localhost:%d/proj/many?fields=name", s.Port)
+			_, _, content := getUrl(url, nil)
+			So(content, ShouldEqual, `[{"name":"jdoe"},{"name":"jdoe"}]`)
+		})
+		Convey("Then ?fields should apply to structs without any rules too", func() {
+			m := get("plain?fields=Root")
+			So(m["Root"], ShouldEqual, "r")
+			So(len(m), ShouldEqual, 1)
+		})
+		Convey("Then ?fields should leave types with their own MarshalJSON alone", func() {
+			url := fmt.Sprintf("http://localhost:%d/proj/custom?fields=Text", s.Port)
+			_, _, content := getUrl(url, nil)
+			So(content, ShouldEqual, `{"said":"hi!"}`)
+		})
+	})
+
+	Convey("Given a handler returning structs with protected fields nested in it", t, func() {
+		m := get("nested")
+
+		Convey("Then pointers, slices and maps of them should be projected too", func() {
+			So(m["name"], ShouldEqual, "ops")
+			lead := m["lead"].(map[string]interface{})
+			So(lead["name"], ShouldEqual, "jdoe")
+			So(lead, ShouldNotContainKey, "password")
+			So(lead, ShouldNotContainKey, "salary")
+			member := m["members"].([]interface{})[0].(map[string]interface{})
+			So(member, ShouldNotContainKey, "password")
+			desk := m["by_desk"].(map[string]interface{})["d1"].(map[string]interface{})
+			So(desk, ShouldNotContainKey, "flags")
+		})
+		Convey("Then nested fields should be projected for cached values too", func() {
+			p := planOf(reflect.TypeOf(team{}))
+			var cached map[string]interface{}
+			b, _ := json.Marshal((&projService{}).Nested())
+			json.Unmarshal(b, &cached)
+			out := p.filter(cached, Principal{}, nil)
+			So(out["lead"], ShouldNotContainKey, "password")
+			So(out["members"].([]interface{})[0], ShouldNotContainKey, "password")
+			So(out["by_desk"].(map[string]interface{})["d1"], ShouldNotContainKey, "salary")
+		})
+	})
+
+	Convey("Given a model with protected fields", t, func() {
+		p := planOf(reflect.TypeOf(&account{}))
+
+		Convey("Then only readable fields can be selected", func() {
+			cols, err := p.columns([]string{"name"}, Principal{})
+			So(err, ShouldBeNil)
+			So(cols, ShouldResemble, []string{"id", "name"})
+
+			_, err = p.columns([]string{"salary"}, Principal{})
+			So(err, ShouldNotBeNil)
+
+			cols, err = p.columns([]string{"salary"}, Principal{Roles: []string{"admin"}})
+			So(err, ShouldBeNil)
+			So(cols, ShouldResemble, []string{"id", "salary"})
+		})
+		Convey("Then hidden fields should be dropped from user input", func() {
+			a := &account{Name: "x", Flags: 9, Password: "p"}
+			p.scrub(a)
+			So(a.Flags, ShouldEqual, 0)
+			So(a.Password, ShouldEqual, "p")
+
+			data := map[string]interface{}{"name": "y", "flags": 1}
+			p.scrubData(data)
+			So(data, ShouldNotContainKey, "flags")
+		})
+	})
+}
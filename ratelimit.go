@@ -0,0 +1,205 @@
+package aqua
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mayur-tolexo/aero/refl"
+)
+
+// A rate like 100/m lets a client make 100 requests a minute, in bursts of
+// up to 100 (a token bucket that holds 100 tokens and refills at 100 per
+// minute). The period is s, m, h, d or a duration (e.g. 10/30s). Clients are
+// told apart by rate_by:
+//
+//   ip         the client ip
+//   key        the api key authorized by KeyAuth, else the ip
+//   principal  the authenticated principal, else the ip (default)
+//
+// Modules run ahead of the Authorizer, so ModRateLimit knows only principals
+// set by earlier modules.
+
+// RateStore keeps the token buckets of the rate limits
+type RateStore interface {
+	// Take takes a token from the bucket of key, which holds up to limit
+	// tokens and is refilled at limit tokens per period
+	Take(key string, limit int, per time.Duration) (Bucket, error)
+}
+
+// Bucket is the state of a token bucket once a token was (or was not) taken
+type Bucket struct {
+	Taken bool
+	Left  int
+	Reset time.Duration // until the bucket is full again
+	Retry time.Duration // until the next token, when none was taken
+}
+
+type rate struct {
+	limit int
+	per   time.Duration
+	by    string
+}
+
+// parseRate reads a rate like 100/m and the way clients are told apart
+func parseRate(s string, by string) (rate, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return rate{}, fmt.Errorf("invalid rate %q, expected e.g. 100/m", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || n <= 0 {
+		return rate{}, fmt.Errorf("invalid rate %q, expected e.g. 100/m", s)
+	}
+	var per time.Duration
+	switch u := strings.TrimSpace(parts[1]); u {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	case "d":
+		per = 24 * time.Hour
+	default:
+		if per, err = time.ParseDuration(u); err != nil || per <= 0 {
+			return rate{}, fmt.Errorf("invalid rate period %q", u)
+		}
+	}
+	switch by {
+	case "":
+		by = "principal"
+	case "ip", "key", "principal":
+	default:
+		return rate{}, fmt.Errorf("invalid rate_by %q, expected ip, key or principal", by)
+	}
+	return rate{limit: n, per: per, by: by}, nil
+}
+
+// client returns who the request is counted against
+func (rt rate) client(r *http.Request) string {
+	switch rt.by {
+	case "key":
+		if p := principalOf(r); p.apiKey {
+			return "key:" + p.Id
+		}
+	case "principal":
+		if p := principalOf(r); p.Authenticated() {
+			return "principal:" + p.Id
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// enforce takes a token for the request from the bucket of the client, and
+// sets the RateLimit headers. A request over the limit gets a 429 fault.
+func (rt rate) enforce(w http.ResponseWriter, r *http.Request, store RateStore, scope string) error {
+	b, err := store.Take(scope+"|"+rt.client(r), rt.limit, rt.per)
+	if err != nil {
+		// the limit is not enforced while the store is down
+		log.Println("aqua: rate store failed:", err)
+		return nil
+	}
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(rt.limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(b.Left))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(b.Reset)))
+	if b.Taken {
+		return nil
+	}
+	h.Set("Retry-After", strconv.Itoa(seconds(b.Retry)))
+	return Fault{
+		HTTPCode: http.StatusTooManyRequests,
+		Message:  "Too many requests",
+		Issue:    fmt.Errorf("limited to %d requests per %s", rt.limit, rt.per),
+	}
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// ModRateLimit returns a module that limits requests before they reach the
+// endpoint (and its authorizer), e.g. ModRateLimit("1000/m", "ip", nil) to
+// hold off floods. The store is kept in memory if nil.
+func ModRateLimit(limit string, by string, store RateStore) func(http.Handler) http.Handler {
+	rt, err := parseRate(limit, by)
+	if err != nil {
+		panic(err)
+	}
+	if store == nil {
+		store = MemoryRates()
+	}
+	scope := fmt.Sprintf("mod:%p", &rt)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := rt.enforce(w, r, store, scope); err != nil {
+				writeItem(w, r, refl.ObjSignature(err), reflect.ValueOf(err), "false")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type memBucket struct {
+	tokens float64
+	at     time.Time
+	full   time.Time
+}
+
+type memRates struct {
+	sync.Mutex
+	buckets map[string]*memBucket
+	swept   time.Time
+}
+
+// MemoryRates returns a rate store that is kept in memory, so each server
+// counts on its own
+func MemoryRates() RateStore {
+	return &memRates{buckets: make(map[string]*memBucket), swept: time.Now()}
+}
+
+func (m *memRates) Take(key string, limit int, per time.Duration) (Bucket, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	rate := float64(limit) / per.Seconds() // tokens per second
+
+	// buckets that have filled up again need not be kept
+	if now.Sub(m.swept) > time.Minute {
+		for k, b := range m.buckets {
+			if now.After(b.full) {
+				delete(m.buckets, k)
+			}
+		}
+		m.swept = now
+	}
+
+	b, found := m.buckets[key]
+	if !found {
+		b = &memBucket{tokens: float64(limit), at: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit), b.tokens+now.Sub(b.at).Seconds()*rate)
+	b.at = now
+
+	out := Bucket{}
+	if b.tokens >= 1 {
+		b.tokens--
+		out.Taken = true
+	} else {
+		out.Retry = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	out.Left = int(b.tokens)
+	out.Reset = time.Duration((float64(limit) - b.tokens) / rate * float64(time.Second))
+	b.full = now.Add(out.Reset)
+	return out, nil
+}
@@ -0,0 +1,143 @@
+package aqua
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type limitedService struct {
+	RestService
+	search GET `url:"/search" rate:"2/m"`
+	mine   GET `url:"/mine" rate:"1/m" rate_by:"principal" mods:"user"`
+	flood  GET `url:"/flood" mods:"flood"`
+}
+
+func (s *limitedService) Search() string {
+	return "found"
+}
+
+func (s *limitedService) Mine() string {
+	return "mine"
+}
+
+func (s *limitedService) Flood() string {
+	return "ok"
+}
+
+func TestRateLimit(t *testing.T) {
+
+	Convey("Given rates", t, func() {
+		Convey("Then they should be parsed", func() {
+			rt, err := parseRate("100/m", "")
+			So(err, ShouldBeNil)
+			So(rt, ShouldResemble, rate{limit: 100, per: time.Minute, by: "principal"})
+			rt, _ = parseRate("10/30s", "ip")
+			So(rt.per, ShouldEqual, 30*time.Second)
+			So(rt.by, ShouldEqual, "ip")
+		})
+		Convey("Then invalid rates should be refused", func() {
+			for _, s := range []string{"100", "x/m", "0/m", "5/fortnight"} {
+				_, err := parseRate(s, "")
+				So(err, ShouldNotBeNil)
+			}
+			_, err := parseRate("5/m", "cookie")
+			So(err, ShouldNotBeNil)
+			So(func() { NewEndPoint(NewMethodInvoker(&limitedService{}, "Search"), Fixture{Rate: "lots"}, "GET", nil, nil, nil) }, ShouldPanic)
+		})
+	})
+
+	Convey("Given a rate counted by api key", t, func() {
+		rt, _ := parseRate("5/m", "key")
+		store := MemoryKeys()
+		k, key, _ := NewApiKey("partner")
+		store.Add(k)
+		a := &KeyAuth{Store: store, Header: "X-Partner-Key"}
+
+		Convey("Then keys of KeyAuth should be counted, whatever their header", func() {
+			r, _ := http.NewRequest("GET", "/search", nil)
+			r.Header.Set("X-Partner-Key", key)
+			p, err := a.Identify(r, "", "")
+			So(err, ShouldBeNil)
+			So(rt.client(WithPrincipal(r, p)), ShouldEqual, "key:"+k.Id)
+		})
+		Convey("Then other callers should be counted by ip", func() {
+			r, _ := http.NewRequest("GET", "/search", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			r.Header.Set("X-Api-Key", "made-up")
+			So(rt.client(r), ShouldEqual, "ip:192.0.2.1")
+			So(rt.client(WithPrincipal(r, Principal{Id: "u1"})), ShouldEqual, "ip:192.0.2.1")
+		})
+	})
+
+	Convey("Given a memory rate store", t, func() {
+		m := MemoryRates()
+
+		Convey("Then a bucket should run out and fill up again", func() {
+			for i := 1; i >= 0; i-- {
+				b, _ := m.Take("k", 2, 100*time.Millisecond)
+				So(b.Taken, ShouldBeTrue)
+				So(b.Left, ShouldEqual, i)
+			}
+			b, _ := m.Take("k", 2, 100*time.Millisecond)
+			So(b.Taken, ShouldBeFalse)
+			So(b.Retry, ShouldBeGreaterThan, 0)
+			So(b.Retry, ShouldBeLessThanOrEqualTo, 50*time.Millisecond)
+
+			time.Sleep(60 * time.Millisecond)
+			b, _ = m.Take("k", 2, 100*time.Millisecond)
+			So(b.Taken, ShouldBeTrue)
+			b, _ = m.Take("other", 2, 100*time.Millisecond)
+			So(b.Left, ShouldEqual, 1)
+		})
+	})
+
+	s := NewRestServer()
+	s.AddModule("user", modUser())
+	s.AddModule("flood", ModRateLimit("1/h", "ip", nil))
+	s.AddService(&limitedService{})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	get := func(path string, user string) *http.Response {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/limited%s", s.Port, path), nil)
+		req.Header.Set("X-User", user)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	Convey("Given an endpoint with a rate", t, func() {
+
+		Convey("Then requests over the rate should get a 429", func() {
+			resp := get("/search", "")
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(resp.Header.Get("RateLimit-Limit"), ShouldEqual, "2")
+			So(resp.Header.Get("RateLimit-Remaining"), ShouldEqual, "1")
+			So(resp.Header.Get("RateLimit-Reset"), ShouldEqual, "30")
+
+			So(get("/search", "").StatusCode, ShouldEqual, 200)
+			resp = get("/search", "")
+			So(resp.StatusCode, ShouldEqual, 429)
+			So(resp.Header.Get("RateLimit-Remaining"), ShouldEqual, "0")
+			So(resp.Header.Get("Retry-After"), ShouldEqual, "30")
+		})
+		Convey("Then each principal should have a bucket of its own", func() {
+			So(get("/mine", "ann").StatusCode, ShouldEqual, 200)
+			So(get("/mine", "ann").StatusCode, ShouldEqual, 429)
+			So(get("/mine", "bob").StatusCode, ShouldEqual, 200)
+		})
+		Convey("Then the rate module should hold off requests before the endpoint", func() {
+			So(get("/flood", "").StatusCode, ShouldEqual, 200)
+			resp := get("/flood", "")
+			So(resp.StatusCode, ShouldEqual, 429)
+			So(resp.Header.Get("Retry-After"), ShouldEqual, "3600")
+		})
+	})
+}
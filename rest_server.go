@@ -2,7 +2,10 @@ package aqua
 
 import (
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
 	"reflect"
 	"strings"
 	"time"
@@ -17,6 +20,24 @@ type Authorizer interface {
 	Authorize(r *http.Request, allow string, deny string) bool
 }
 
+// IdentityAuthorizer is an Authorizer that also tells who the caller is.
+// The principal it returns is attached to the request, where handlers, crud
+// hooks and audits find it (see Aide.Principal), even on public endpoints.
+// A caller that is turned away gets the error. The built-in authorizers let
+// callers without credentials through when allow and deny permit anyone, and
+// otherwise refuse missing or bad credentials with Unauthenticated (401) and
+// credentials that do not pass allow/deny with Forbidden (403).
+type IdentityAuthorizer interface {
+	Authorizer
+	Identify(r *http.Request, allow string, deny string) (Principal, error)
+}
+
+// AuthFailureFunc is told of every request turned away by the Authorizer
+type AuthFailureFunc func(r *http.Request, f Fault)
+
+// AuditFailureFunc is told of every audit entry that its sink failed to record
+type AuditFailureFunc func(e AuditEntry, err error)
+
 var defaults Fixture = Fixture{
 	Pretty: "false",
 	Vendor: "vnd.api",
@@ -35,6 +56,16 @@ type RestServer struct {
 	mods   map[string]func(http.Handler) http.Handler
 	stores map[string]cache.Cacher
 	auth   Authorizer
+	audits map[string]*CRUD
+
+	authFailed  AuthFailureFunc
+	auditFailed AuditFailureFunc
+	rates       RateStore
+	preflights  map[string]*preflight
+	proxies     []*net.IPNet
+
+	schema    SchemaMode
+	schemaOut io.Writer
 }
 
 func NewRestServer() RestServer {
@@ -47,8 +78,14 @@ func NewRestServer() RestServer {
 		apis:    make(map[string]endPoint),
 		mods:    make(map[string]func(http.Handler) http.Handler),
 		stores:  make(map[string]cache.Cacher),
+		audits:  make(map[string]*CRUD),
+		rates:   MemoryRates(),
+
+		preflights: make(map[string]*preflight),
+
+		schemaOut: os.Stdout,
 	}
-	r.AddService(&CoreService{})
+	r.AddService(&CoreService{audits: r.audits})
 	return r
 }
 
@@ -70,6 +107,53 @@ func (me *RestServer) SetAuth(a Authorizer) {
 	me.auth = a
 }
 
+// SetAuthFailureHook sets a func that is called with each request turned away
+// by the Authorizer, along with the fault it gets, e.g. for security logging
+func (me *RestServer) SetAuthFailureHook(fn AuthFailureFunc) {
+	me.authFailed = fn
+}
+
+// SetAuditFailureHook sets a func that is called with each entry that a CRUD
+// Audit sink fails to record, e.g. to alert or to keep it elsewhere. Without
+// one, the failures are logged.
+func (me *RestServer) SetAuditFailureHook(fn AuditFailureFunc) {
+	me.auditFailed = fn
+}
+
+// SetTrustedProxies sets the ips and cidrs of the proxies and load balancers
+// in front of the server. Their X-Forwarded-For (or Forwarded) header is taken
+// to find the client ip, which is used by allow_ip/deny_ip, rate limits and
+// the access log.
+func (me *RestServer) SetTrustedProxies(cidrs ...string) {
+	nets, err := parseNets(strings.Join(cidrs, ","))
+	if err != nil {
+		panic(err)
+	}
+	me.proxies = nets
+}
+
+// SetTls makes the server serve https (and verify client certificates, if
+// set up to). It panics if the certificates cannot be loaded.
+func (me *RestServer) SetTls(t Tls) {
+	cfg, err := t.config()
+	if err != nil {
+		panic(err)
+	}
+	me.TLSConfig = cfg
+}
+
+// SetRateStore sets where the buckets of the rate limits are kept, e.g. a
+// store shared by all servers (they are kept in memory by default)
+func (me *RestServer) SetRateStore(s RateStore) {
+	me.rates = s
+}
+
+// SetSchema sets what is done with the tables of CRUD models at startup:
+// nothing (default), auto-migrate, check or print the migration DDL
+func (me *RestServer) SetSchema(mode SchemaMode) {
+	me.schema = mode
+}
+
 func (me *RestServer) loadAllEndpoints() {
 	for _, i := range me.svcs {
 		me.loadServiceEndpoints(i)
@@ -132,107 +216,69 @@ func (me *RestServer) loadServiceEndpoints(svc interface{}) {
 			vals := reflect.ValueOf(svc).MethodByName(str.SentenceCase(field.Name)).Call([]reflect.Value{})
 			crud := vals[0].Interface().(CRUD)
 
+			crud.Fixture = fix
 			crud.useMasterIfMissing()
 			crud.validate()
-			crud.Fixture = fix
-
-			var exec Invoker
-			var f Fixture
-
-			// Setup GET endpoint and handler (for Reads)
-			{
-				f = fix
-				f.Url += "/{pkey}"
-				meth := crud.getMethod("read")
-				if meth != "" {
-					exec = NewMethodInvoker(&crud, meth)
-					ep := NewEndPoint(exec, f, "GET", me.mods, me.stores, me.auth)
-					ep.setupMuxHandlers(me.mux)
-					me.addServiceToList(ep)
-				}
+			crud.syncSchema(me.schema, me.schemaOut)
+			validateOps(fix.Ops)
+			crud.resource = strings.Trim(strings.Trim(fix.Root, "/")+"/"+strings.Trim(fix.Url, "/"), "/")
+			fix.Root = crud.parentRoot(fix.Root)
+			crud.Root = fix.Root
+			crud.svc = svc
+			crud.auth = me.auth
+			crud.auditFailed = me.auditFailed
+			if crud.Audit != nil {
+				me.audits[crud.resource] = &crud
 			}
 
-			// Setup Create (post) endpoint
-			{
-				f = fix
-				meth := crud.getMethod("create")
-				if meth != "" {
-					exec = NewMethodInvoker(&crud, meth)
-					ep := NewEndPoint(exec, f, "POST", me.mods, me.stores, me.auth)
-					ep.setupMuxHandlers(me.mux)
-					me.addServiceToList(ep)
-				}
+			// Collection endpoints need the 2nd return of Model()
+			fn := crud.Model
+			var col interface{}
+			if fn != nil {
+				_, col = crud.Model()
 			}
 
-			// Setup DELETE (delete) endpoint
-			{
-				f = fix
-				f.Url += "/{pkey}"
-				meth := crud.getMethod("delete")
-				if meth != "" {
-					exec = NewMethodInvoker(&crud, meth)
-					ep := NewEndPoint(exec, f, "DELETE", me.mods, me.stores, me.auth)
-					ep.setupMuxHandlers(me.mux)
-					me.addServiceToList(ep)
-				}
+			// Setup GET endpoint for aggregates. This must be registered
+			// before reads, else it would be served as a read of pkey "aggregate"
+			if col != nil {
+				me.mountCrud(&crud, fix, "aggregate", "GET", "/aggregate")
+				me.mountCrud(&crud, fix, "export", "GET", "/export")
 			}
 
-			//Setup Update (put) endpoint
-			{
-				f = fix
-				f.Url += "/{pkey}"
-				meth := crud.getMethod("update")
-				if meth != "" {
-					exec = NewMethodInvoker(&crud, meth)
-					ep := NewEndPoint(exec, f, "PUT", me.mods, me.stores, me.auth)
-					ep.setupMuxHandlers(me.mux)
-					me.addServiceToList(ep)
-				}
-			}
+			// Setup GET (read), POST (create), DELETE and PUT (update) endpoints
+			me.mountCrud(&crud, fix, "read", "GET", "/{pkey}")
+			me.mountCrud(&crud, fix, "create", "POST", "")
+			me.mountCrud(&crud, fix, "delete", "DELETE", "/{pkey}")
+			me.mountCrud(&crud, fix, "update", "PUT", "/{pkey}")
 
-			// Setup additional POST handler for ad-hoc queries
-			fn := crud.Model
-			var col interface{}
-			if fn != nil {
-				_, col = crud.Model()
+			// Setup POST endpoint to restore soft deleted rows
+			if crud.SoftDelete {
+				me.mountCrud(&crud, fix, "restore", "POST", "/{pkey}/restore")
 			}
 
+			// Setup additional handlers for listing and ad-hoc queries
 			if col != nil {
 
+				// GET endpoint for listing with filters in the query string
+				me.mountCrud(&crud, fix, "list", "GET", "")
+
+				// POST endpoint for bulk loads of csv or ndjson
+				me.mountCrud(&crud, fix, "import", "POST", "/import")
+
 				// POST endpoint /[]
 				// SQL is found in Post body
-				{
-					f = fix
-					f.Url += "/!"
-					meth := crud.getMethod("sql")
-					if meth != "" {
-						exec = NewMethodInvoker(&crud, meth)
-						ep := NewEndPoint(exec, f, "POST", me.mods, me.stores, me.auth)
-						ep.setupMuxHandlers(me.mux)
-						me.addServiceToList(ep)
-					}
-				}
+				me.mountCrud(&crud, fix, "sql", "POST", "/!")
 
 				// POST endpoint /$
 				// SQL and params are found in Post body in json form
-				{
-					f = fix
-					f.Url += "/$"
-					meth := crud.getMethod("sqlJson")
-					if meth != "" {
-						exec = NewMethodInvoker(&crud, meth)
-						ep := NewEndPoint(exec, f, "POST", me.mods, me.stores, me.auth)
-						ep.setupMuxHandlers(me.mux)
-						me.addServiceToList(ep)
-					}
-				}
+				me.mountCrud(&crud, fix, "sqlJson", "POST", "/$")
 			}
 
 		} else {
 
 			exec := NewMethodInvoker(svc, str.SentenceCase(field.Name))
 			if exec.exists || fix.Stub != "" {
-				ep := NewEndPoint(exec, fix, method, me.mods, me.stores, me.auth)
+				ep := me.newEndPoint(exec, fix, method)
 				ep.setupMuxHandlers(me.mux)
 				me.addServiceToList(ep)
 			}
@@ -240,6 +286,39 @@ func (me *RestServer) loadServiceEndpoints(svc interface{}) {
 	}
 }
 
+// mountCrud sets up the endpoint of a crud action, if the storage engine supports it
+func (me *RestServer) mountCrud(crud *CRUD, f Fixture, action string, httpMethod string, suffix string) {
+	meth := crud.getMethod(action)
+	if meth == "" || !f.hasOp(crudOps[action][0]) {
+		return
+	}
+	f.Url += suffix
+	f.Allow, f.Deny = f.acl(crudOps[action][1])
+	ep := me.newEndPoint(NewMethodInvoker(crud, meth), f, httpMethod)
+	ep.guard = crud.guard
+	if strings.Contains(suffix, "{pkey}") && crud.Model != nil {
+		if m, _ := crud.Model(); m != nil {
+			if vars := keyVars(m); vars != nil {
+				ep.spreadKey(vars)
+			}
+		}
+	}
+	ep.setupMuxHandlers(me.mux)
+	me.addServiceToList(ep)
+}
+
+// newEndPoint creates an endpoint with the modules, caches and security
+// settings of the server
+func (me *RestServer) newEndPoint(inv Invoker, f Fixture, httpMethod string) endPoint {
+	ep := NewEndPoint(inv, f, httpMethod, me.mods, me.stores, me.auth)
+	ep.authFailed = me.authFailed
+	ep.preflights = me.preflights
+	if ep.rate != nil {
+		ep.rates = me.rates
+	}
+	return ep
+}
+
 func (me *RestServer) addServiceToList(ep endPoint) {
 	if _, found := me.apis[ep.svcId]; found {
 		panic(fmt.Sprintf("Multiple services found: %s", ep.svcId))
@@ -255,6 +334,10 @@ func (me *RestServer) validateService(svc interface{}) {
 	if !refl.ComposedOf(svc, RestService{}) {
 		panic("RestServer.AddService() expects object that contains anonymous RestService field")
 	}
+	// without an Authorizer, the admin expression would not be checked at all
+	if _, ok := svc.(*KeyService); ok && me.auth == nil {
+		panic("KeyService needs an Authorizer, see RestServer.SetAuth()")
+	}
 }
 
 func (me *RestServer) Run() {
@@ -277,6 +360,10 @@ func startup(r *RestServer, port int) {
 	} else if r.Server.Addr == "" {
 		r.Addr = fmt.Sprintf(":%d", port)
 	}
-	r.Server.Handler = r.mux
-	fmt.Println(r.ListenAndServe())
+	r.Server.Handler = resolveClient(r.mux, r.proxies)
+	if r.TLSConfig != nil {
+		fmt.Println(r.ListenAndServeTLS("", ""))
+	} else {
+		fmt.Println(r.ListenAndServe())
+	}
 }
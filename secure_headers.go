@@ -0,0 +1,62 @@
+package aqua
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The secure tag ("true" to turn on, usually for the whole server through
+// RestServer.Fixture, and "false" to turn off per service or endpoint) sets
+// the security headers of the responses:
+//
+//	Strict-Transport-Security  max-age=31536000; includeSubDomains (https only)
+//	X-Content-Type-Options     nosniff
+//	X-Frame-Options            DENY
+//	Referrer-Policy            no-referrer
+//	Content-Security-Policy    the csp tag, or default-src 'none'; frame-ancestors 'none'
+//	Cache-Control              the cache_control tag, or no-store
+//
+// The defaults suit json apis; html pages and stubs can set a csp and
+// cache_control of their own ("-" leaves the header out). Handlers can
+// still set any of the headers themselves.
+type secureHeaders struct {
+	csp   string
+	cache string
+}
+
+const (
+	defaultCsp          = "default-src 'none'; frame-ancestors 'none'"
+	defaultCacheControl = "no-store"
+)
+
+// newSecureHeaders reads the secure setup of a fixture, and returns nil if off
+func newSecureHeaders(f Fixture) (*secureHeaders, error) {
+	switch f.Secure {
+	case "", "false":
+		return nil, nil
+	case "true":
+	default:
+		return nil, fmt.Errorf("invalid secure %q, expected true or false", f.Secure)
+	}
+	return &secureHeaders{csp: pick(f.Csp, defaultCsp), cache: pick(f.CacheControl, defaultCacheControl)}, nil
+}
+
+// wrap sets the headers before the endpoint (and its modules) run
+func (s *secureHeaders) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if clientHttps(r) {
+			h.Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		if s.csp != "-" {
+			h.Set("Content-Security-Policy", s.csp)
+		}
+		if s.cache != "-" {
+			h.Set("Cache-Control", s.cache)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,97 @@
+package aqua
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type secureService struct {
+	RestService
+	api    GET `url:"/api"`
+	page   GET `url:"/page" csp:"default-src 'self'" cache_control:"max-age=60"`
+	bare   GET `url:"/bare" csp:"-" cache_control:"-"`
+	legacy GET `url:"/legacy" secure:"false"`
+}
+
+func (s *secureService) Api() string {
+	return "api"
+}
+
+func (s *secureService) Page() string {
+	return "page"
+}
+
+func (s *secureService) Bare() string {
+	return "bare"
+}
+
+func (s *secureService) Legacy() string {
+	return "legacy"
+}
+
+func TestSecureHeaders(t *testing.T) {
+
+	Convey("Given an invalid secure tag", t, func() {
+		Convey("Then it should be refused at startup", func() {
+			_, err := newSecureHeaders(Fixture{Secure: "yes"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	s := NewRestServer()
+	s.Secure = "true"
+	s.SetTrustedProxies("127.0.0.1")
+	s.AddService(&secureService{})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	get := func(path string, proto string) http.Header {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/secure%s", s.Port, path), nil)
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		resp.Body.Close()
+		return resp.Header
+	}
+
+	Convey("Given a server with security headers", t, func() {
+
+		Convey("Then responses should carry the defaults", func() {
+			h := get("/api", "")
+			So(h.Get("X-Content-Type-Options"), ShouldEqual, "nosniff")
+			So(h.Get("X-Frame-Options"), ShouldEqual, "DENY")
+			So(h.Get("Referrer-Policy"), ShouldEqual, "no-referrer")
+			So(h.Get("Content-Security-Policy"), ShouldEqual, defaultCsp)
+			So(h.Get("Cache-Control"), ShouldEqual, "no-store")
+			So(h.Get("Strict-Transport-Security"), ShouldBeEmpty)
+		})
+		Convey("Then hsts should be sent to clients on https only", func() {
+			h := get("/api", "https")
+			So(h.Get("Strict-Transport-Security"), ShouldEqual, "max-age=31536000; includeSubDomains")
+			h = get("/api", "http")
+			So(h.Get("Strict-Transport-Security"), ShouldBeEmpty)
+		})
+		Convey("Then endpoints should be able to change the csp and cache control", func() {
+			h := get("/page", "")
+			So(h.Get("Content-Security-Policy"), ShouldEqual, "default-src 'self'")
+			So(h.Get("Cache-Control"), ShouldEqual, "max-age=60")
+
+			h = get("/bare", "")
+			So(h.Get("Content-Security-Policy"), ShouldBeEmpty)
+			So(h.Get("Cache-Control"), ShouldBeEmpty)
+			So(h.Get("X-Content-Type-Options"), ShouldEqual, "nosniff")
+		})
+		Convey("Then endpoints should be able to turn them off", func() {
+			h := get("/legacy", "https")
+			So(h.Get("X-Content-Type-Options"), ShouldBeEmpty)
+			So(h.Get("Strict-Transport-Security"), ShouldBeEmpty)
+		})
+	})
+}
@@ -59,6 +59,9 @@ func writeItem(w http.ResponseWriter, r *http.Request, sign string, val reflect.
 		if err != nil {
 			panic(err)
 		}
+		if f.HTTPCode == 401 && f.challenge != "" {
+			w.Header().Set("WWW-Authenticate", f.challenge)
+		}
 		if f.HTTPCode != 0 {
 			w.WriteHeader(f.HTTPCode)
 		} else {
@@ -99,12 +102,12 @@ func writeItem(w http.ResponseWriter, r *http.Request, sign string, val reflect.
 		w.Header().Set("Content-Length", strconv.Itoa(len(j)))
 		w.Write(j)
 	case strings.HasPrefix(sign, "st:"):
-		j, _ := ds.ToBytes(val.Interface(), pretty == "true" || pretty == "1")
+		j, _ := ds.ToBytes(project(val, sign, r).Interface(), pretty == "true" || pretty == "1")
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Content-Length", strconv.Itoa(len(j)))
 		w.Write(j)
 	case strings.HasPrefix(sign, "sl:"), strings.HasPrefix(sign, "ar:"):
-		j, _ := ds.ToBytes(val.Interface(), pretty == "true" || pretty == "1")
+		j, _ := ds.ToBytes(project(val, sign, r).Interface(), pretty == "true" || pretty == "1")
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Content-Length", strconv.Itoa(len(j)))
 		w.Write(j)
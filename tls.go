@@ -0,0 +1,139 @@
+package aqua
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Tls sets up https for a RestServer (see SetTls). The certificate and key
+// files are read again when they change, so that certificates can be renewed
+// without a restart. With ClientCAs, clients can present a certificate signed
+// by one of those CAs (and must, with RequireClientCert); CertAuth authorizes
+// them by their certificate.
+type Tls struct {
+	CertFile string
+	KeyFile  string
+
+	// tls.VersionTLS12 by default; the go defaults are used for the ciphers
+	MinVersion uint16
+	Ciphers    []uint16
+
+	// pem bundle of the CAs that client certificates are verified against
+	ClientCAs         string
+	RequireClientCert bool
+}
+
+// certificate files are checked for changes at most this often
+var certCheckEvery = 10 * time.Second
+
+// config builds the tls config of the server
+func (t Tls) config() (*tls.Config, error) {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, errors.New("tls needs a certificate and a key file")
+	}
+	kp := &keyPair{cert: t.CertFile, key: t.KeyFile}
+	if err := kp.load(); err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: kp.get,
+		MinVersion:     t.MinVersion,
+		CipherSuites:   t.Ciphers,
+	}
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	for _, c := range t.Ciphers {
+		if tls.CipherSuiteName(c) == fmt.Sprintf("0x%04X", c) {
+			return nil, fmt.Errorf("unknown tls cipher suite 0x%04X", c)
+		}
+	}
+
+	if t.ClientCAs != "" {
+		pem, err := ioutil.ReadFile(t.ClientCAs)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.ClientCAs)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if t.RequireClientCert {
+		return nil, errors.New("tls needs ClientCAs to require client certificates")
+	}
+	return cfg, nil
+}
+
+// keyPair is a certificate that is loaded again when its files change
+type keyPair struct {
+	sync.RWMutex
+	cert    string
+	key     string
+	pair    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (k *keyPair) load() error {
+	mod, err := lastModified(k.cert, k.key)
+	if err != nil {
+		return err
+	}
+	pair, err := tls.LoadX509KeyPair(k.cert, k.key)
+	if err != nil {
+		return err
+	}
+	k.Lock()
+	k.pair, k.modTime, k.checked = &pair, mod, time.Now()
+	k.Unlock()
+	return nil
+}
+
+func (k *keyPair) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.RLock()
+	pair, due := k.pair, time.Since(k.checked) >= certCheckEvery
+	k.RUnlock()
+	if !due {
+		return pair, nil
+	}
+
+	k.Lock()
+	k.checked = time.Now()
+	k.Unlock()
+	if mod, err := lastModified(k.cert, k.key); err == nil && !mod.Equal(k.modTime) {
+		// a renewal that is only half written is tried again at the next check
+		if err := k.load(); err != nil {
+			log.Println("aqua: certificate could not be reloaded:", err)
+		}
+	}
+	k.RLock()
+	defer k.RUnlock()
+	return k.pair, nil
+}
+
+func lastModified(files ...string) (time.Time, error) {
+	var out time.Time
+	for _, f := range files {
+		st, err := os.Stat(f)
+		if err != nil {
+			return out, err
+		}
+		if st.ModTime().After(out) {
+			out = st.ModTime()
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,193 @@
+package aqua
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type billingService struct {
+	RestService
+	charge POST `url:"/charge" allow:"cn:billing-service"`
+	whoami GET  `url:"/whoami"`
+}
+
+func (s *billingService) Charge(j Aide) string {
+	return "charged by " + j.Principal().Id
+}
+
+func (s *billingService) Whoami(j Aide) string {
+	if c := j.ClientCert(); c != nil {
+		return c.Subject.CommonName
+	}
+	return "anonymous"
+}
+
+// testCert issues a certificate signed by parent (self signed if nil)
+func testCert(cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn, OrganizationalUnit: []string{"payments"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn + ".internal", "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tpl.IsCA, tpl.BasicConstraintsValid = true, true
+		parent, parentKey = tpl, key
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	c, _ := x509.ParseCertificate(der)
+	return c, key
+}
+
+func writePem(path string, c *x509.Certificate, key *ecdsa.PrivateKey) {
+	out := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	ioutil.WriteFile(path+".crt", out, 0600)
+	if key != nil {
+		der, _ := x509.MarshalECPrivateKey(key)
+		ioutil.WriteFile(path+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	}
+}
+
+func TestTls(t *testing.T) {
+
+	Convey("Given a client certificate with a san only", t, func() {
+		c := &x509.Certificate{DNSNames: []string{"billing.svc.cluster.local"}}
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{c}}}
+
+		Convey("Then the san should be the principal", func() {
+			p, err := CertAuth{}.Identify(r, "sub:billing.svc.cluster.local", "")
+			So(err, ShouldBeNil)
+			So(p.Id, ShouldEqual, "billing.svc.cluster.local")
+		})
+	})
+
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	at := func(name string) string { return filepath.Join(dir, name) }
+
+	ca, caKey := testCert("test-ca", nil, nil)
+	writePem(at("ca"), ca, nil)
+	srv, srvKey := testCert("server", ca, caKey)
+	writePem(at("server"), srv, srvKey)
+	billing, billingKey := testCert("billing-service", ca, caKey)
+	shop, shopKey := testCert("shop", ca, caKey)
+	rogueCa, rogueKey := testCert("rogue-ca", nil, nil)
+	rogue, rogueCertKey := testCert("billing-service", rogueCa, rogueKey)
+
+	Convey("Given tls settings", t, func() {
+		Convey("Then invalid ones should be refused", func() {
+			_, err := Tls{CertFile: at("none.crt"), KeyFile: at("none.key")}.config()
+			So(err, ShouldNotBeNil)
+			_, err = Tls{CertFile: at("server.crt"), KeyFile: at("server.key"), RequireClientCert: true}.config()
+			So(err, ShouldNotBeNil)
+			_, err = Tls{CertFile: at("server.crt"), KeyFile: at("server.key"), Ciphers: []uint16{0x0bad}}.config()
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Then tls 1.2 should be the minimum by default", func() {
+			cfg, err := Tls{CertFile: at("server.crt"), KeyFile: at("server.key")}.config()
+			So(err, ShouldBeNil)
+			So(cfg.MinVersion, ShouldEqual, tls.VersionTLS12)
+			So(cfg.ClientAuth, ShouldEqual, tls.NoClientCert)
+		})
+	})
+
+	s := NewRestServer()
+	s.SetTls(Tls{CertFile: at("server.crt"), KeyFile: at("server.key"), ClientCAs: at("ca.crt")})
+	s.SetAuth(CertAuth{})
+	s.AddService(&billingService{})
+	s.Port = getUniquePortForTestCase()
+	s.RunAsync()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	client := func(c *x509.Certificate, key *ecdsa.PrivateKey) *http.Client {
+		cfg := &tls.Config{RootCAs: roots}
+		if c != nil {
+			// sent even when the server asks for another CA
+			cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &tls.Certificate{Certificate: [][]byte{c.Raw}, PrivateKey: key}, nil
+			}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	}
+	call := func(cl *http.Client, method string, path string) (int, string) {
+		req, _ := http.NewRequest(method, fmt.Sprintf("https://localhost:%d/billing%s", s.Port, path), nil)
+		resp, err := cl.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	Convey("Given a server with mutual tls", t, func() {
+
+		Convey("Then services should be authorized by their certificate", func() {
+			code, body := call(client(billing, billingKey), "POST", "/charge")
+			So(code, ShouldEqual, 200)
+			So(body, ShouldEqual, "charged by billing-service")
+
+			code, _ = call(client(shop, shopKey), "POST", "/charge")
+			So(code, ShouldEqual, 403)
+			code, _ = call(client(nil, nil), "POST", "/charge")
+			So(code, ShouldEqual, 401)
+		})
+		Convey("Then handlers should see the client certificate", func() {
+			_, body := call(client(shop, shopKey), "GET", "/whoami")
+			So(body, ShouldEqual, "shop")
+			_, body = call(client(nil, nil), "GET", "/whoami")
+			So(body, ShouldEqual, "anonymous")
+		})
+		Convey("Then certificates of other CAs should be refused", func() {
+			code, _ := call(client(rogue, rogueCertKey), "GET", "/whoami")
+			So(code, ShouldEqual, 0)
+		})
+		Convey("Then a certificate should be read as claims", func() {
+			c := certClaims(billing)
+			So(matchExpr(c, "san:billing-service.internal"), ShouldBeTrue)
+			So(matchExpr(c, "san:127.0.0.1"), ShouldBeTrue)
+			So(matchExpr(c, "ou:payments"), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a renewed server certificate", t, func() {
+		saved := certCheckEvery
+		certCheckEvery = 0
+		defer func() { certCheckEvery = saved }()
+
+		renewed, renewedKey := testCert("renewed", ca, caKey)
+		time.Sleep(10 * time.Millisecond)
+		writePem(at("server"), renewed, renewedKey)
+
+		Convey("Then it should be served without a restart", func() {
+			conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", s.Port), &tls.Config{RootCAs: roots})
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			So(conn.ConnectionState().PeerCertificates[0].Subject.CommonName, ShouldEqual, "renewed")
+		})
+	})
+}